@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+const (
+	keyTargets     = "targets"
+	keyTargetsFile = "targets_file"
+	keyBalancer    = "balancer"
+
+	balancerPickFirst = "pick_first"
+	balancerWeighted  = "weighted"
+
+	// backendsScheme is the scheme of the resolver of the targets list
+	backendsScheme = "grpctest"
+	// targetsReloadDelay is how long the targets file must stay unchanged before it's reloaded
+	targetsReloadDelay = time.Millisecond * 200
+)
+
+var (
+	balancers = []string{balancerPickFirst, roundrobin.Name, balancerWeighted}
+	// backends count the calls and streams sent to every backend
+	backends = &backendStats{counts: make(map[string]*backendCount)}
+)
+
+func init() {
+	viper.SetDefault(keyBalancer, balancerPickFirst)
+	balancer.Register(base.NewBalancerBuilderWithConfig(balancerWeighted, weightedPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+// dialTarget return the target to dial and its balancer option. The targets can be a list of
+// host:port=weight, a name resolved by gRPC like dns:///host:port, or a file listing the backends,
+// reloaded when it change. Without targets, it's the single server.
+func dialTarget(server string, port int, log *zap.Logger) (string, []grpc.DialOption, error) {
+	targets := viper.GetStringSlice(keyTargets)
+	targetsFile := viper.GetString(keyTargetsFile)
+	if len(targets) == 0 && len(targetsFile) == 0 {
+		if common.IsUnixAddress(server) {
+			return server, nil, nil
+		}
+		return net.JoinHostPort(server, strconv.Itoa(port)), nil, nil
+	}
+	if len(targets) > 0 && len(targetsFile) > 0 {
+		return "", nil, errors.Errorf("Set either %q or %q, not both", keyTargets, keyTargetsFile)
+	}
+
+	name := viper.GetString(keyBalancer)
+	if !stringInSlice(name, balancers) {
+		return "", nil, errors.Errorf("Unknown balancer %q, expected one of %s", name, strings.Join(balancers, ", "))
+	}
+	options := []grpc.DialOption{grpc.WithBalancerName(name)}
+	backends.enabled = true
+
+	if len(targets) == 1 && strings.Contains(targets[0], "://") {
+		return targets[0], options, nil
+	}
+	var (
+		addrs []resolver.Address
+		err   error
+	)
+	if len(targetsFile) > 0 {
+		addrs, err = readBackendsFile(targetsFile, port)
+	} else {
+		addrs, err = parseBackends(targets, port)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if len(addrs) == 0 {
+		return "", nil, errors.New("Empty targets list")
+	}
+	r := manual.NewBuilderWithScheme(backendsScheme)
+	r.InitialAddrs(addrs)
+	resolver.Register(r)
+	if len(targetsFile) > 0 {
+		watchBackendsFile(targetsFile, port, r, log)
+	}
+	log.Info("Balance between backends", zap.String("balancer", name), zap.Int("backends", len(addrs)))
+	return backendsScheme + ":///backends", options, nil
+}
+
+// parseBackends parse a list of host:port=weight or unix addresses, the port and the weight are optional
+func parseBackends(list []string, port int) ([]resolver.Address, error) {
+	addrs := make([]resolver.Address, 0, len(list))
+	for _, s := range list {
+		weight := 1
+		if i := strings.LastIndex(s, "="); i >= 0 {
+			w, err := strconv.Atoi(s[i+1:])
+			if err != nil || w <= 0 {
+				return nil, errors.Errorf("Invalid weight of backend %q", s)
+			}
+			s, weight = s[:i], w
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil && !common.IsUnixAddress(s) {
+			s = net.JoinHostPort(s, strconv.Itoa(port))
+		}
+		addrs = append(addrs, resolver.Address{Addr: s, Metadata: weight})
+	}
+	return addrs, nil
+}
+
+// readBackendsFile read a backend per line, empty lines and lines starting with # are ignored
+func readBackendsFile(path string, port int) ([]resolver.Address, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read targets file")
+	}
+	defer f.Close()
+	var list []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			list = append(list, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Can't read targets file")
+	}
+	return parseBackends(list, port)
+}
+
+// watchBackendsFile update the backends of r whenever the targets file change
+func watchBackendsFile(path string, port int, r *manual.Resolver, log *zap.Logger) {
+	reload := func() {
+		addrs, err := readBackendsFile(path, port)
+		if err != nil {
+			log.Error("Can't reload targets, keep the current ones", zap.Error(err))
+			return
+		}
+		log.Info("Targets reloaded", zap.Int("backends", len(addrs)))
+		r.NewAddress(addrs)
+	}
+	if err := common.WatchFile(path, targetsReloadDelay, reload, log); err != nil {
+		log.Error("Can't watch targets file", zap.Error(err))
+	}
+}
+
+// weightedPickerBuilder pick the ready backends in proportion of their weight
+type weightedPickerBuilder struct{}
+
+func (weightedPickerBuilder) Build(readySCs map[resolver.Address]balancer.SubConn) balancer.Picker {
+	if len(readySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &weightedPicker{}
+	for addr, sc := range readySCs {
+		weight, ok := addr.Metadata.(int)
+		if !ok || weight <= 0 {
+			weight = 1
+		}
+		p.subConns = append(p.subConns, sc)
+		p.weights = append(p.weights, weight)
+		p.total += weight
+	}
+	p.current = make([]int, len(p.subConns))
+	return p
+}
+
+// weightedPicker is a smooth weighted round robin, it spread the picks of a backend instead of grouping them
+type weightedPicker struct {
+	subConns []balancer.SubConn
+	weights  []int
+	total    int
+
+	mu      sync.Mutex
+	current []int
+}
+
+func (p *weightedPicker) Pick(ctx context.Context, opts balancer.PickOptions) (balancer.SubConn, func(balancer.DoneInfo), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := 0
+	for i, w := range p.weights {
+		p.current[i] += w
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.subConns[best], nil, nil
+}
+
+// backendStats count the calls and streams by backend, as seen by the client
+type backendStats struct {
+	// enabled is true when the client balance between several backends
+	enabled bool
+
+	mu     sync.Mutex
+	order  []string
+	counts map[string]*backendCount
+}
+
+type backendCount struct {
+	unary   int64
+	streams int64
+}
+
+func (b *backendStats) record(addr string, stream bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.counts[addr]
+	if !ok {
+		c = &backendCount{}
+		b.counts[addr] = c
+		b.order = append(b.order, addr)
+	}
+	if stream {
+		c.streams++
+		backendCalls.WithLabelValues(addr, "stream").Inc()
+	} else {
+		c.unary++
+		backendCalls.WithLabelValues(addr, "unary").Inc()
+	}
+}
+
+// reports return the count of every backend, sorted by address
+func (b *backendStats) reports() []backendReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := append([]string(nil), b.order...)
+	sort.Strings(addrs)
+	reports := make([]backendReport, 0, len(addrs))
+	for _, addr := range addrs {
+		c := b.counts[addr]
+		reports = append(reports, backendReport{Backend: addr, Unary: c.unary, Streams: c.streams})
+	}
+	return reports
+}
+
+type backendReport struct {
+	Backend string `json:"backend"`
+	Unary   int64  `json:"unary"`
+	Streams int64  `json:"streams"`
+}
+
+// BackendUnaryClientInterceptor record the backend of every unary call
+func BackendUnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		var p peer.Peer
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Peer(&p))...)
+		if p.Addr != nil {
+			backends.record(p.Addr.String(), false)
+		}
+		return err
+	}
+}
+
+// BackendStreamClientInterceptor record the backend of every stream
+func BackendStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return cs, err
+		}
+		if p, ok := peer.FromContext(cs.Context()); ok && p.Addr != nil {
+			backends.record(p.Addr.String(), true)
+		}
+		return cs, nil
+	}
+}
+
+// printBackendSummary write the share of the calls and streams of every backend, when balancing
+func printBackendSummary(w io.Writer) {
+	if !backends.enabled {
+		return
+	}
+	reports := backends.reports()
+	var unary, streams int64
+	for _, r := range reports {
+		unary += r.Unary
+		streams += r.Streams
+	}
+	percent := func(n, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(total)
+	}
+	for _, r := range reports {
+		fmt.Fprintf(w, "backend %-21s unary=%d (%.1f%%) streams=%d (%.1f%%)\n",
+			r.Backend, r.Unary, percent(r.Unary, unary), r.Streams, percent(r.Streams, streams))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestParseBackends(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    []string
+		want    []resolver.Address
+		wantErr bool
+	}{
+		{
+			name: "default port and weight",
+			list: []string{"a", "b:9000"},
+			want: []resolver.Address{{Addr: "a:8080", Metadata: 1}, {Addr: "b:9000", Metadata: 1}},
+		},
+		{
+			name: "weights",
+			list: []string{"a=3", "b:9000=1", "[::1]:9000=2"},
+			want: []resolver.Address{{Addr: "a:8080", Metadata: 3}, {Addr: "b:9000", Metadata: 1}, {Addr: "[::1]:9000", Metadata: 2}},
+		},
+		{
+			name: "unix",
+			list: []string{"unix:/tmp/grpctest.sock=2", "unix-abstract:grpctest"},
+			want: []resolver.Address{{Addr: "unix:/tmp/grpctest.sock", Metadata: 2}, {Addr: "unix-abstract:grpctest", Metadata: 1}},
+		},
+		{
+			name: "empty",
+			list: nil,
+			want: []resolver.Address{},
+		},
+		{name: "zero weight", list: []string{"a=0"}, wantErr: true},
+		{name: "negative weight", list: []string{"a=-1"}, wantErr: true},
+		{name: "invalid weight", list: []string{"a:9000=x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBackends(tt.list, 8080)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBackends(%q) error %v, want error %v", tt.list, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBackends(%q) = %v, want %v", tt.list, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeSubConn is a ready backend of the picker
+type fakeSubConn struct {
+	name string
+}
+
+func (*fakeSubConn) UpdateAddresses([]resolver.Address) {}
+func (*fakeSubConn) Connect()                           {}
+
+func TestWeightedPicker(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		// maxRun is the longest run of picks of the same backend, grouping the picks would be the weight
+		maxRun int
+	}{
+		{name: "single", weights: []int{1}, maxRun: 3},
+		{name: "equal", weights: []int{3, 3}, maxRun: 1},
+		{name: "double", weights: []int{2, 1}, maxRun: 2},
+		{name: "skewed", weights: []int{5, 1, 1}, maxRun: 4},
+		{name: "round robin", weights: []int{1, 1, 1}, maxRun: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readySCs := make(map[resolver.Address]balancer.SubConn)
+			weights := make(map[balancer.SubConn]int)
+			total := 0
+			for i, w := range tt.weights {
+				sc := &fakeSubConn{name: strconv.Itoa(i)}
+				readySCs[resolver.Address{Addr: sc.name, Metadata: w}] = sc
+				weights[sc] = w
+				total += w
+			}
+			picker := weightedPickerBuilder{}.Build(readySCs)
+
+			const rounds = 3
+			var (
+				last balancer.SubConn
+				run  int
+			)
+			counts := make(map[balancer.SubConn]int)
+			for i := 0; i < rounds*total; i++ {
+				sc, _, err := picker.Pick(context.Background(), balancer.PickOptions{})
+				if err != nil {
+					t.Fatalf("Pick() error %v", err)
+				}
+				counts[sc]++
+				if sc == last {
+					run++
+				} else {
+					last, run = sc, 1
+				}
+				if run > tt.maxRun {
+					t.Fatalf("Pick() chose backend %s %d times in a row, want at most %d", sc.(*fakeSubConn).name, run, tt.maxRun)
+				}
+				if (i+1)%total == 0 {
+					// every round of total picks follow the weights exactly
+					for sc, w := range weights {
+						if want := w * (i + 1) / total; counts[sc] != want {
+							t.Fatalf("backend %s picked %d times after %d picks, want %d", sc.(*fakeSubConn).name, counts[sc], i+1, want)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedPickerNoBackend(t *testing.T) {
+	picker := weightedPickerBuilder{}.Build(nil)
+	if _, _, err := picker.Pick(context.Background(), balancer.PickOptions{}); err != balancer.ErrNoSubConnAvailable {
+		t.Errorf("Pick() error %v, want %v", err, balancer.ErrNoSubConnAvailable)
+	}
+}
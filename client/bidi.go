@@ -1,11 +1,10 @@
 package main
 
 import (
-	"crypto/rand"
 	"io"
+	"sync/atomic"
 	"time"
 
-	"github.com/oklog/ulid"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
@@ -24,34 +23,47 @@ func bidiCommand() *cobra.Command {
 		interval    time.Duration
 	)
 	return &cobra.Command{
-		Use:   "bidi",
-		Short: "Run bidirectional client",
+		Use:         "bidi",
+		Short:       "Run bidirectional client",
+		Annotations: runAnnotations,
 		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
 			authContext, client, interval, log, err = preUp()
 			return
 		},
-		Run: func(_ *cobra.Command, _ []string) {
-			BidirectionalClientTest(authContext, client, interval, log)
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return BidirectionalClientTest(authContext, client, interval, log)
 		},
 	}
 }
 
-// BidirectionalClientTest connect to a server and periodically send request, log response when it receive one. try forever
-func BidirectionalClientTest(authContext func(context.Context) context.Context, client grpctest.GrpcTestClient, interval time.Duration, log *zap.Logger) {
+// BidirectionalClientTest connect to a server and periodically send request, log response when it receive one.
+// try until interrupted or the reconnect policy give up, the stream is closed by both sides on interrupt
+func BidirectionalClientTest(authContext func(context.Context) context.Context, client grpctest.GrpcTestClient, interval time.Duration, log *zap.Logger) error {
 
 	var (
 		ctx      context.Context
 		cancelFn context.CancelFunc
 		respChan = make(chan *grpctest.Response, 1)
 	)
+	// the sequence continue across reconnects, so the server can detect lost requests
+	seq, err := common.NewSequencer()
+	if err != nil {
+		return err
+	}
+	backoff := common.NewBackoff(backoffPolicy)
+	stats := runStats.get(kindBidi)
 
-	for {
+	for shutdown.Err() == nil {
 		log.Debug("Connect to gRPC server")
 		ctx, cancelFn = context.WithCancel(context.Background())
 		stream, err := client.BiDirectionalStream(authContext(ctx))
 		if err != nil {
 			log.Error("Can't open stream, try again", zap.Error(err))
-			time.Sleep(common.ReconnectInterval)
+			stats.fail(err)
+			countReconnect(kindBidi)
+			if err = backoff.Wait(shutdown, log); err != nil {
+				return err
+			}
 			continue
 		}
 		log.Debug("Connected")
@@ -74,43 +86,99 @@ func BidirectionalClientTest(authContext func(context.Context) context.Context,
 						return
 					}
 					log.Error("Error receive stream", zap.Error(err))
+					stats.fail(err)
 					return
 				}
 			}
 		}()
 
 		ticker := time.NewTicker(interval)
+		refresh := tokenRefreshTimer()
+		var (
+			tick         = ticker.C
+			interrupted  = shutdown.Done()
+			closing      <-chan time.Time
+			lastReceived time.Time
+			refreshed    bool
+			// pending hold the value of requests waiting for their echo, by sequence
+			pending = make(map[uint64]string)
+		)
 
 	selectLoop:
 		for {
 			select {
-			case t := <-ticker.C:
+			case t := <-tick:
 				// send some dummy request
-				id, err := ulid.New(ulid.Timestamp(t), rand.Reader)
+				req, err := newRequest(seq, t)
 				if err != nil {
 					log.Error("Can't generate ULID", zap.Error(err))
 					cancelFn()
 					break selectLoop
 				}
-				req := &grpctest.Request{
-					Value: id.String(),
-				}
 				if err := stream.Send(req); err != nil {
 					log.Error("Can't send interval request", zap.Error(err))
+					stats.fail(err)
 					cancelFn()
 					break selectLoop
 				}
+				atomic.AddInt64(&stats.sent, 1)
+				atomic.AddInt64(&stats.ops, 1)
+				if echoCount > 0 {
+					pending[req.Sequence] = req.Value
+				}
 				log.Debug("Sent interval request", req.ZapFields()...)
 			case <-ctx.Done():
 				log.Info("Context done, stop receive from stream", zap.Error(ctx.Err()))
 				break selectLoop
+			case <-interrupted:
+				// stop sending, and keep receiving until the server end the stream
+				log.Info("Interrupted, close stream")
+				if err := stream.CloseSend(); err != nil {
+					log.Debug("Can't close stream", zap.Error(err))
+				}
+				tick, interrupted, closing = nil, nil, time.After(closeTimeout)
+			case <-closing:
+				log.Warn("Stream not ended by the server, cancel it")
+				cancelFn()
+				break selectLoop
+			case <-refresh.C:
+				log.Info("Token about to expire, reopen stream")
+				if err := stream.CloseSend(); err != nil {
+					log.Debug("Can't close stream", zap.Error(err))
+				}
+				cancelFn()
+				refreshed = true
+				break selectLoop
 			case resp := <-respChan:
 				// process response
+				now := time.Now()
+				if !lastReceived.IsZero() {
+					latencies.Record(latencyInterArrival, now.Sub(lastReceived))
+				}
+				lastReceived = now
+				backoff.Reset()
+				atomic.AddInt64(&stats.received, 1)
 				log.Debug("Received response", resp.ZapFields()...)
+				observeResponse(log, resp)
+				if value, ok := pending[resp.Sequence]; ok {
+					delete(pending, resp.Sequence)
+					latencies.Record(latencyEchoBidi, now.Sub(time.Unix(0, resp.SentAt)))
+					verifyEcho(log, value, resp)
+				}
 			}
 		}
 
+		ticker.Stop()
+		refresh.Stop()
+		if refreshed || shutdown.Err() != nil {
+			continue
+		}
+
 		log.Debug("Disconnected from server, reconnect")
-		time.Sleep(common.ReconnectInterval)
+		countReconnect(kindBidi)
+		if err = backoff.Wait(shutdown, log); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+func callCommand() *cobra.Command {
+	var (
+		authContext   func(context.Context) context.Context
+		log           *zap.Logger
+		descriptorSet string
+		data          []string
+	)
+	cmd := &cobra.Command{
+		Use:   "call [service/method]",
+		Short: "List the services of the server, or call a method with JSON messages",
+		Long: `List the services and methods of the server, found by reflection or in a descriptor set,
+or call a method. The requests are the --data flags, or a stream of JSON objects read from stdin,
+and every response is printed as JSON.`,
+		Args: cobra.MaximumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			authContext, _, _, log, err = preUp()
+			return
+		},
+		RunE: func(_ *cobra.Command, args []string) error {
+			ctx := authContext(shutdown)
+			services, err := loadServices(ctx, descriptorSet)
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				printServices(os.Stdout, services)
+				return nil
+			}
+			method, err := findMethod(services, args[0])
+			if err != nil {
+				return err
+			}
+			var requests []json.RawMessage
+			for _, d := range data {
+				requests = append(requests, json.RawMessage(d))
+			}
+			if len(requests) == 0 {
+				if requests, err = readMessages(os.Stdin); err != nil {
+					return err
+				}
+			}
+			log.Debug("Call method", zap.String("method", method.GetFullyQualifiedName()), zap.Int("requests", len(requests)))
+			return DynamicCall(ctx, method, requests, os.Stdout)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&descriptorSet, "descriptor-set", "", "file descriptor set describing the services, instead of the server reflection")
+	flags.StringArrayVarP(&data, "data", "d", nil, "JSON request, repeat it for client streams, read from stdin when missing")
+	return cmd
+}
+
+// loadServices describe the services of the server, using reflection or the descriptor set file if it isn't empty
+func loadServices(ctx context.Context, descriptorSet string) (map[string]*desc.ServiceDescriptor, error) {
+	services := make(map[string]*desc.ServiceDescriptor)
+	if len(descriptorSet) > 0 {
+		b, err := ioutil.ReadFile(descriptorSet)
+		if err != nil {
+			return nil, err
+		}
+		var fds dpb.FileDescriptorSet
+		if err = proto.Unmarshal(b, &fds); err != nil {
+			return nil, errors.Wrapf(err, "Can't parse descriptor set %q", descriptorSet)
+		}
+		files, err := desc.CreateFileDescriptorsFromSet(&fds)
+		if err != nil {
+			return nil, err
+		}
+		for _, fd := range files {
+			for _, sd := range fd.GetServices() {
+				services[sd.GetFullyQualifiedName()] = sd
+			}
+		}
+		return services, nil
+	}
+
+	reflection := grpcreflect.NewClient(ctx, rpb.NewServerReflectionClient(clientConn))
+	defer reflection.Reset()
+	names, err := reflection.ListServices()
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't list services by reflection")
+	}
+	for _, name := range names {
+		fd, err := reflection.FileContainingSymbol(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can't describe service %q", name)
+		}
+		if sd := fd.FindService(name); sd != nil {
+			services[name] = sd
+		}
+	}
+	return services, nil
+}
+
+func printServices(w io.Writer, services map[string]*desc.ServiceDescriptor) {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+		for _, md := range services[name].GetMethods() {
+			fmt.Fprintf(w, "  %s(%s%s) %s%s\n", md.GetName(),
+				streamPrefix(md.IsClientStreaming()), md.GetInputType().GetFullyQualifiedName(),
+				streamPrefix(md.IsServerStreaming()), md.GetOutputType().GetFullyQualifiedName())
+		}
+	}
+}
+
+func streamPrefix(streaming bool) string {
+	if streaming {
+		return "stream "
+	}
+	return ""
+}
+
+// findMethod find a method named as service/method or service.method
+func findMethod(services map[string]*desc.ServiceDescriptor, name string) (*desc.MethodDescriptor, error) {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		i = strings.LastIndex(name, ".")
+	}
+	if i <= 0 {
+		return nil, errors.Errorf("Invalid method %q, expected service/method", name)
+	}
+	sd, ok := services[name[:i]]
+	if !ok {
+		return nil, errors.Errorf("Unknown service %q", name[:i])
+	}
+	md := sd.FindMethodByName(name[i+1:])
+	if md == nil {
+		return nil, errors.Errorf("Unknown method %q of service %q", name[i+1:], name[:i])
+	}
+	return md, nil
+}
+
+// readMessages read a stream of JSON values
+func readMessages(r io.Reader) ([]json.RawMessage, error) {
+	var messages []json.RawMessage
+	dec := json.NewDecoder(r)
+	for {
+		var msg json.RawMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return messages, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "Can't read JSON request")
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// DynamicCall call method with the JSON requests and write every response as a line of JSON
+func DynamicCall(ctx context.Context, method *desc.MethodDescriptor, requests []json.RawMessage, w io.Writer) error {
+	messages := make([]proto.Message, len(requests))
+	for i, req := range requests {
+		msg := dynamic.NewMessage(method.GetInputType())
+		if err := msg.UnmarshalJSON(req); err != nil {
+			return errors.Wrapf(err, "Can't parse request %d as %s", i+1, method.GetInputType().GetFullyQualifiedName())
+		}
+		messages[i] = msg
+	}
+	if !method.IsClientStreaming() && len(messages) != 1 {
+		return errors.Errorf("Method %s expect a single request, got %d", method.GetName(), len(messages))
+	}
+
+	stub := grpcdynamic.NewStub(clientConn)
+	switch {
+	case method.IsClientStreaming() && method.IsServerStreaming():
+		stream, err := stub.InvokeRpcBidiStream(ctx, method)
+		if err != nil {
+			return err
+		}
+		sendErr := make(chan error, 1)
+		go func() {
+			for _, msg := range messages {
+				if err := stream.SendMsg(msg); err != nil {
+					sendErr <- err
+					return
+				}
+			}
+			sendErr <- stream.CloseSend()
+		}()
+		if err = printStream(w, stream.RecvMsg); err != nil {
+			return err
+		}
+		return <-sendErr
+	case method.IsClientStreaming():
+		stream, err := stub.InvokeRpcClientStream(ctx, method)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			if err = stream.SendMsg(msg); err != nil {
+				return err
+			}
+		}
+		resp, err := stream.CloseAndReceive()
+		if err != nil {
+			return err
+		}
+		return printMessage(w, resp)
+	case method.IsServerStreaming():
+		stream, err := stub.InvokeRpcServerStream(ctx, method, messages[0])
+		if err != nil {
+			return err
+		}
+		return printStream(w, stream.RecvMsg)
+	default:
+		resp, err := stub.InvokeRpc(ctx, method, messages[0])
+		if err != nil {
+			return err
+		}
+		return printMessage(w, resp)
+	}
+}
+
+// printStream print the messages received until the end of the stream
+func printStream(w io.Writer, recv func() (proto.Message, error)) error {
+	for {
+		resp, err := recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = printMessage(w, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func printMessage(w io.Writer, msg proto.Message) error {
+	dm, err := dynamic.AsDynamicMessage(msg)
+	if err != nil {
+		return err
+	}
+	b, err := dm.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
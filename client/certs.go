@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+func certsCommand() *cobra.Command {
+	var (
+		dir      string
+		hosts    []string
+		validity time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "certs",
+		Short: "Generate a self-signed CA with server and client certificates",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			if len(hosts) == 0 {
+				return errors.Errorf("Missing %q", "host")
+			}
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+			if err := common.GenerateCertificates(dir, hosts, validity); err != nil {
+				return err
+			}
+			fmt.Printf("Certificates written to %s\n", dir)
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&dir, "dir", "certs", "directory where certificates are written")
+	flags.StringSliceVar(&hosts, "host", []string{"localhost", "127.0.0.1"}, "DNS names and IP addresses of the server certificate")
+	flags.DurationVar(&validity, "validity", time.Hour*24*365, "certificates validity")
+	return cmd
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"crypto/rand"
 	"io"
+	"sync/atomic"
 	"time"
 
-	"github.com/oklog/ulid"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
@@ -22,8 +21,9 @@ func clientCommand() *cobra.Command {
 		interval    time.Duration
 	)
 	return &cobra.Command{
-		Use:   "client",
-		Short: "Run client stream",
+		Use:         "client",
+		Short:       "Run client stream",
+		Annotations: runAnnotations,
 		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
 			authContext, client, interval, log, err = preUp()
 			return
@@ -34,7 +34,7 @@ func clientCommand() *cobra.Command {
 	}
 }
 
-// ClientStreamTest connect to a server and periodically send request 10 times and close stream
+// ClientStreamTest connect to a server and periodically send request 10 times and close stream, or earlier when interrupted
 func ClientStreamTest(authContext func(context.Context) context.Context, client grpctest.GrpcTestClient, interval time.Duration, log *zap.Logger) error {
 	const maxSend = 10
 	var (
@@ -43,40 +43,69 @@ func ClientStreamTest(authContext func(context.Context) context.Context, client
 		sent     int
 	)
 	log = log.With(zap.Int("max", maxSend))
+	// the sequence continue across reconnects, so the server can detect lost requests
+	seq, err := common.NewSequencer()
+	if err != nil {
+		return err
+	}
+	backoff := common.NewBackoff(backoffPolicy)
+	stats := runStats.get(kindClient)
 
-	for {
+	for shutdown.Err() == nil {
 		log.Debug("Connect to gRPC server")
 		ctx, cancelFn = context.WithCancel(context.Background())
 		stream, err := client.ClientStream(authContext(ctx))
 		if err != nil {
 			log.Error("Can't open stream, try again", zap.Error(err))
-			time.Sleep(common.ReconnectInterval)
+			stats.fail(err)
+			countReconnect(kindClient)
+			if err = backoff.Wait(shutdown, log); err != nil {
+				return err
+			}
 			continue
 		}
 		log.Debug("Connected")
 
+		// digest cover the requests sent on this stream, to verify the server summary in echo mode
+		digest := common.NewDigest()
 		ticker := time.NewTicker(interval)
+		closeStream := func(log *zap.Logger) error {
+			ticker.Stop()
+			resp, err := stream.CloseAndRecv()
+			if err != nil && err != io.EOF {
+				stats.fail(err)
+				return err
+			}
+			atomic.AddInt64(&stats.ops, 1)
+			atomic.AddInt64(&stats.received, 1)
+			log.Debug("Got response", resp.ZapFields()...)
+			if echoCount > 0 && resp != nil {
+				return verifyAggregate(digest, resp)
+			}
+			return nil
+		}
 
 	selectLoop:
 		for {
 			select {
 			case t := <-ticker.C:
 				// send some dummy request
-				id, err := ulid.New(ulid.Timestamp(t), rand.Reader)
+				req, err := newRequest(seq, t)
 				if err != nil {
 					log.Error("Can't generate ULID", zap.Error(err))
 					cancelFn()
 					break selectLoop
 				}
-				req := &grpctest.Request{
-					Value: id.String(),
-				}
 				if err := stream.Send(req); err != nil {
 					log.Error("Can't send interval request", zap.Error(err))
+					stats.fail(err)
 					cancelFn()
 					break selectLoop
 				}
+				digest.Add(req.Value, req.Payload)
+				atomic.AddInt64(&stats.sent, 1)
 				sent++
+				backoff.Reset()
 				sLog := log.With(zap.Int("sent", sent))
 				if sent <= maxSend {
 					sLog.Debug("Sent interval request", req.ZapFields()...)
@@ -84,19 +113,22 @@ func ClientStreamTest(authContext func(context.Context) context.Context, client
 				}
 
 				sLog.Debug("Maximum sent, close stream")
-				resp, err := stream.CloseAndRecv()
-				if err != nil && err != io.EOF {
-					return err
-				}
-				sLog.Debug("Got response", resp.ZapFields()...)
-				return nil
+				return closeStream(sLog)
+			case <-shutdown.Done():
+				log.Info("Interrupted, close stream", zap.Int("sent", sent))
+				return closeStream(log)
 			case <-ctx.Done():
 				log.Info("Context done, stop receive from stream", zap.Error(ctx.Err()))
 				break selectLoop
 			}
 		}
+		ticker.Stop()
 
 		log.Debug("Disconnected from server, reconnect")
-		time.Sleep(common.ReconnectInterval)
+		countReconnect(kindClient)
+		if err = backoff.Wait(shutdown, log); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/stats"
+
+	"github.com/bclermont/grpctest/common"
+	grpctest "github.com/bclermont/grpctest/proto"
+)
+
+const (
+	keyCompressor = "compressor"
+	// messageHeaderLen is the gRPC header of every message, counted in the wire length of sent messages only
+	messageHeaderLen = 5
+)
+
+// compression count the bytes of the messages before and after compression, for the summary
+var compression = &compressionStats{seen: make(map[string]int64)}
+
+// compressorOptions return the call options using the compressor name, none if it's empty
+func compressorOptions(name string) []grpc.CallOption {
+	if len(name) == 0 {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(name)}
+}
+
+// countDecompression wrap the registered compressors to count the received compressed messages, since
+// gRPC doesn't report their wire length
+func countDecompression() {
+	for _, name := range common.Compressors() {
+		encoding.RegisterCompressor(&countingCompressor{Compressor: encoding.GetCompressor(name), stats: compression})
+	}
+}
+
+type countingCompressor struct {
+	encoding.Compressor
+	stats *compressionStats
+}
+
+func (c *countingCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	dr, err := c.Compressor.Decompress(&countingReader{Reader: r, n: &c.stats.compressed})
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{Reader: dr, n: &c.stats.decompressed}, nil
+}
+
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// compressionStats is a stats handler counting the message bytes and the compressors seen by the server
+type compressionStats struct {
+	sent, sentWire int64
+	received       int64
+	// compressed and decompressed are the sizes of the received compressed messages
+	compressed, decompressed int64
+
+	mu sync.Mutex
+	// seen count the responses by the compressor of the requests echoed by the server
+	seen map[string]int64
+}
+
+func (c *compressionStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c *compressionStats) HandleRPC(_ context.Context, s stats.RPCStats) {
+	switch p := s.(type) {
+	case *stats.OutPayload:
+		atomic.AddInt64(&c.sent, int64(p.Length))
+		atomic.AddInt64(&c.sentWire, int64(p.WireLength-messageHeaderLen))
+	case *stats.InPayload:
+		atomic.AddInt64(&c.received, int64(p.Length))
+		if resp, ok := p.Payload.(*grpctest.Response); ok && len(resp.Compressor) > 0 {
+			c.mu.Lock()
+			c.seen[resp.Compressor]++
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *compressionStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (c *compressionStats) HandleConn(context.Context, stats.ConnStats) {}
+
+type compressionReport struct {
+	Compressor    string           `json:"compressor"`
+	Sent          int64            `json:"sent_bytes"`
+	SentWire      int64            `json:"sent_wire_bytes"`
+	Received      int64            `json:"received_bytes"`
+	ReceivedWire  int64            `json:"received_wire_bytes"`
+	ServerSaw     map[string]int64 `json:"server_saw"`
+	SentRatio     float64          `json:"sent_ratio"`
+	ReceivedRatio float64          `json:"received_ratio"`
+}
+
+// report return the byte counts, nil if no message was sent or received
+func (c *compressionStats) report(compressor string) *compressionReport {
+	r := &compressionReport{
+		Compressor: compressor,
+		Sent:       atomic.LoadInt64(&c.sent),
+		SentWire:   atomic.LoadInt64(&c.sentWire),
+		Received:   atomic.LoadInt64(&c.received),
+		ServerSaw:  make(map[string]int64),
+	}
+	r.ReceivedWire = r.Received - atomic.LoadInt64(&c.decompressed) + atomic.LoadInt64(&c.compressed)
+	if r.Sent+r.Received == 0 {
+		return nil
+	}
+	if len(r.Compressor) == 0 {
+		r.Compressor = common.CompressorIdentity
+	}
+	c.mu.Lock()
+	for name, n := range c.seen {
+		r.ServerSaw[name] = n
+	}
+	c.mu.Unlock()
+	if r.Sent > 0 {
+		r.SentRatio = float64(r.SentWire) / float64(r.Sent)
+	}
+	if r.Received > 0 {
+		r.ReceivedRatio = float64(r.ReceivedWire) / float64(r.Received)
+	}
+	return r
+}
+
+// printCompressionSummary write the message bytes before and after compression, and the compressors seen by the server
+func printCompressionSummary(w io.Writer, compressor string) {
+	r := compression.report(compressor)
+	if r == nil {
+		return
+	}
+	fmt.Fprintf(w, "compression %-8s sent=%d wire=%d (%.1f%%) received=%d wire=%d (%.1f%%)\n", r.Compressor,
+		r.Sent, r.SentWire, r.SentRatio*100, r.Received, r.ReceivedWire, r.ReceivedRatio*100)
+	if len(r.ServerSaw) > 0 {
+		seen := make([]string, 0, len(r.ServerSaw))
+		for name, n := range r.ServerSaw {
+			seen = append(seen, fmt.Sprintf("%s=%d", name, n))
+		}
+		sort.Strings(seen)
+		fmt.Fprintf(w, "server saw compressors %s\n", strings.Join(seen, " "))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	grpctest "github.com/bclermont/grpctest/proto"
+)
+
+const (
+	// keyDeadline is the timeout of every unary call, 0 for none
+	keyDeadline = "deadline"
+	// keyStreamDeadline is the timeout of every stream, from its opening to its end, 0 for none
+	keyStreamDeadline = "stream_deadline"
+)
+
+// withDeadline set timeout on ctx unless it's 0 or ctx already has a deadline, like a scenario step
+func withDeadline(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// recordDeadlineSpent record how much of the deadline was spent before the server received the call,
+// in the network, the proxies and the client interceptors
+func recordDeadlineSpent(budget time.Duration, m interface{}) {
+	if r, ok := m.(*grpctest.Response); ok && r.DeadlineRemaining > 0 {
+		latencies.Record(latencyDeadlineSpent, budget-time.Duration(r.DeadlineRemaining))
+	}
+}
+
+// deadlineBudget return the time left before the deadline of ctx, 0 if it has none
+func deadlineBudget(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return 0
+}
+
+// DeadlineUnaryClientInterceptor set the timeout of the unary calls without deadline
+func DeadlineUnaryClientInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancelFn := withDeadline(ctx, timeout)
+		defer cancelFn()
+		budget := deadlineBudget(ctx)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil && budget > 0 {
+			recordDeadlineSpent(budget, reply)
+		}
+		return err
+	}
+}
+
+// DeadlineStreamClientInterceptor set the timeout of the streams without deadline
+func DeadlineStreamClientInterceptor(timeout time.Duration) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, cancelFn := withDeadline(ctx, timeout)
+		budget := deadlineBudget(ctx)
+		s, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cancelFn()
+			return nil, err
+		}
+		return &deadlineStream{ClientStream: s, desc: desc, budget: budget, cancelFn: cancelFn}, nil
+	}
+}
+
+// deadlineStream release the deadline timer when the stream end
+type deadlineStream struct {
+	grpc.ClientStream
+	desc     *grpc.StreamDesc
+	budget   time.Duration
+	cancelFn context.CancelFunc
+	received bool
+}
+
+func (s *deadlineStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.cancelFn()
+		return err
+	}
+	if !s.received && s.budget > 0 {
+		s.received = true
+		// the server report the deadline of the stream opening in every response
+		recordDeadlineSpent(s.budget, m)
+	}
+	if !s.desc.ServerStreams {
+		// the single response of a client stream end it
+		s.cancelFn()
+	}
+	return nil
+}
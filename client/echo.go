@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/bclermont/grpctest/common"
+	"github.com/bclermont/grpctest/proto"
+)
+
+const (
+	keyEcho         = "echo"
+	latencyEchoBidi = "bidi echo round trip"
+)
+
+var (
+	// echoCount is the number of echoes requested to the server, 0 when echo is disabled
+	echoCount int
+	// echoed and echoMismatches count the verified echo responses
+	echoed, echoMismatches uint64
+)
+
+// verifyEcho check that resp is the echo of a request with value, a mismatch is logged
+func verifyEcho(log *zap.Logger, value string, resp *grpctest.Response) bool {
+	atomic.AddUint64(&echoed, 1)
+	if resp.Value == value {
+		return true
+	}
+	atomic.AddUint64(&echoMismatches, 1)
+	log.Warn("Echo doesn't match request", append(resp.ZapFields(), zap.String("expected", value))...)
+	return false
+}
+
+// verifyAggregate check the summary of a client stream against what was sent
+func verifyAggregate(digest *common.Digest, resp *grpctest.Response) error {
+	if resp.MessageCount != digest.Count || resp.TotalBytes != digest.Bytes || !bytes.Equal(resp.Digest, digest.Sum()) {
+		return fmt.Errorf("Server received %d messages and %d bytes with digest %x, sent %d messages and %d bytes with digest %x",
+			resp.MessageCount, resp.TotalBytes, resp.Digest, digest.Count, digest.Bytes, digest.Sum())
+	}
+	return nil
+}
+
+func printEchoSummary(w io.Writer) {
+	if n := atomic.LoadUint64(&echoed); n > 0 {
+		fmt.Fprintf(w, "%d echo responses, %d mismatches\n", n, atomic.LoadUint64(&echoMismatches))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+// healthCheckTimeout bound a single health check
+const healthCheckTimeout = time.Second * 5
+
+func healthCommand() *cobra.Command {
+	var (
+		authContext func(context.Context) context.Context
+		log         *zap.Logger
+		service     string
+		watch       bool
+	)
+	cmd := &cobra.Command{
+		Use:   "health",
+		Short: "Check the server health, and watch its changes",
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			authContext, _, _, log, err = preUp()
+			return
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			client := healthpb.NewHealthClient(clientConn)
+			if watch {
+				return HealthWatch(authContext, client, service, log)
+			}
+			return HealthCheck(authContext, client, service)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&service, "service", "", "service to check, empty for the whole server")
+	flags.BoolVar(&watch, "watch", false, "print every status change until interrupted")
+	return cmd
+}
+
+// HealthCheck print the serving status of service, it fail if the service isn't serving
+func HealthCheck(authContext func(context.Context) context.Context, client healthpb.HealthClient, service string) error {
+	ctx, cancelFn := context.WithTimeout(authContext(context.Background()), healthCheckTimeout)
+	defer cancelFn()
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(summaryOutput, "%q %s\n", service, resp.Status)
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return errors.Errorf("Service %q is %s", service, resp.Status)
+	}
+	return nil
+}
+
+// HealthWatch print the serving status of service when it change, until interrupted or the reconnect policy give up
+func HealthWatch(authContext func(context.Context) context.Context, client healthpb.HealthClient, service string, log *zap.Logger) error {
+	log = log.With(zap.String("service", service))
+	backoff := common.NewBackoff(backoffPolicy)
+
+	for shutdown.Err() == nil {
+		stream, err := client.Watch(authContext(shutdown), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			log.Error("Can't watch health, try again", common.GrpcErrorFields(err)...)
+			if err = backoff.Wait(shutdown, log); err != nil {
+				return err
+			}
+			continue
+		}
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				if shutdown.Err() != nil {
+					break
+				}
+				if err == io.EOF {
+					log.Info("Watch ended by the server, watch again")
+				} else {
+					log.Error("Can't receive health status, watch again", common.GrpcErrorFields(err)...)
+				}
+				if err = backoff.Wait(shutdown, log); err != nil {
+					return err
+				}
+				break
+			}
+			backoff.Reset()
+			fmt.Fprintf(summaryOutput, "%s %q %s\n", time.Now().Format(time.RFC3339), service, resp.Status)
+		}
+	}
+	return nil
+}
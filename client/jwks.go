@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+func jwksCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "jwks",
+		Short: "Print the JWKS of the JWT signing key, for the server to validate client tokens",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			viper.AutomaticEnv()
+			cfg := common.LoadJWTConfig()
+			if len(cfg.SigningKeyFile) == 0 {
+				return errors.New("Missing JWT signing key")
+			}
+			key, err := loadSigningKey(cfg.SigningKeyFile)
+			if err != nil {
+				return err
+			}
+			jwks := jose.JSONWebKeySet{
+				Keys: []jose.JSONWebKey{{
+					Key:       key.Public(),
+					KeyID:     cfg.KeyID,
+					Algorithm: string(signingAlgorithm(key)),
+					Use:       "sig",
+				}},
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(jwks)
+		},
+	}
+}
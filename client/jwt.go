@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+// tokenSource mint the bearer tokens in JWT mode, nil when a static API key is used
+var tokenSource *jwtSource
+
+// jwtSource mint short-lived tokens and cache them until they are close to expiry
+type jwtSource struct {
+	cfg    common.JWTConfig
+	signer jose.Signer
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newJWTSource(cfg common.JWTConfig) (*jwtSource, error) {
+	var key jose.SigningKey
+	switch {
+	case len(cfg.SigningKeyFile) > 0:
+		privateKey, err := loadSigningKey(cfg.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = jose.SigningKey{Algorithm: signingAlgorithm(privateKey), Key: privateKey}
+	case len(cfg.Secret) > 0:
+		key = jose.SigningKey{Algorithm: jose.HS256, Key: []byte(cfg.Secret)}
+	default:
+		return nil, errors.New("JWT authentication needs a secret or a signing key")
+	}
+	if cfg.TTL <= 0 {
+		return nil, errors.New("JWT TTL must be positive")
+	}
+
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if len(cfg.KeyID) > 0 {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), cfg.KeyID)
+	}
+	signer, err := jose.NewSigner(key, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't create JWT signer")
+	}
+	return &jwtSource{cfg: cfg, signer: signer}, nil
+}
+
+// refreshMargin is how long before expiry a token is replaced
+func (s *jwtSource) refreshMargin() time.Duration {
+	return s.cfg.TTL / 5
+}
+
+// Token return a token valid for at least the refresh margin, and its expiry
+func (s *jwtSource) Token() (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.expiry.Sub(now) > s.refreshMargin() {
+		return s.token, s.expiry, nil
+	}
+
+	claims := jwt.Claims{
+		Subject:   s.cfg.Subject,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(s.cfg.TTL)),
+	}
+	if len(s.cfg.Audience) > 0 {
+		claims.Audience = jwt.Audience{s.cfg.Audience}
+	}
+	token, err := jwt.Signed(s.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "Can't sign JWT")
+	}
+	s.token, s.expiry = token, now.Add(s.cfg.TTL)
+	return s.token, s.expiry, nil
+}
+
+// tokenRefreshTimer return a timer firing when the current token must be replaced, so long-lived streams can
+// reconnect with a fresh one. It never fires with a static API key.
+func tokenRefreshTimer() *time.Timer {
+	if tokenSource == nil {
+		t := time.NewTimer(time.Hour)
+		t.Stop()
+		return t
+	}
+	tokenSource.mu.Lock()
+	defer tokenSource.mu.Unlock()
+	return time.NewTimer(tokenSource.expiry.Sub(time.Now()) - tokenSource.refreshMargin())
+}
+
+// signingAlgorithm return RS256 for RSA keys, ES256, ES384 or ES512 for ECDSA keys depending on their
+// curve, and an empty algorithm for the other keys
+func signingAlgorithm(key crypto.Signer) jose.SignatureAlgorithm {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256
+	case *ecdsa.PrivateKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return jose.ES256
+		case 384:
+			return jose.ES384
+		case 521:
+			return jose.ES512
+		}
+	}
+	return ""
+}
+
+// loadSigningKey read a PEM encoded RSA or ECDSA P-256, P-384 or P-521 private key
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read signing key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("No PEM block in %q", path)
+	}
+	var key crypto.Signer
+	if rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = rsaKey
+	} else if ecKey, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		key = ecKey
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can't parse signing key %q", path)
+		}
+		if signer, ok := parsed.(crypto.Signer); ok {
+			key = signer
+		}
+	}
+	if key == nil || len(signingAlgorithm(key)) == 0 {
+		return nil, errors.Errorf("Unsupported signing key type in %q", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+const (
+	latencyUnary        = "unary round trip"
+	latencyFirstMessage = "server stream first message"
+	latencyInterArrival = "bidi inter-arrival"
+	// latencyDeadlineSpent is the part of the deadline spent before the server received the call
+	latencyDeadlineSpent = "deadline spent before server"
+
+	latencyMin     = int64(time.Microsecond)
+	latencyMax     = int64(10 * time.Minute)
+	latencySigFigs = 3
+)
+
+var (
+	latencyPercentiles = []float64{50, 90, 99, 99.9}
+	// latencies is shared by all the commands, it's reported when the command exit
+	latencies = newLatencyRecorder()
+)
+
+// latencyRecorder keep one HDR histogram per measured latency
+type latencyRecorder struct {
+	mu         sync.Mutex
+	names      []string
+	histograms map[string]*hdrhistogram.Histogram
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{
+		histograms: make(map[string]*hdrhistogram.Histogram),
+	}
+}
+
+// Record add a latency measure to the histogram name
+func (r *latencyRecorder) Record(name string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[name]
+	if !ok {
+		h = hdrhistogram.New(latencyMin, latencyMax, latencySigFigs)
+		r.histograms[name] = h
+		r.names = append(r.names, name)
+	}
+	// out of range values are clamped rather than lost
+	v := int64(d)
+	if v < latencyMin {
+		v = latencyMin
+	} else if v > latencyMax {
+		v = latencyMax
+	}
+	h.RecordValue(v)
+}
+
+// Report write percentiles of every histogram to w
+func (r *latencyRecorder) Report(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range r.names {
+		h := r.histograms[name]
+		fmt.Fprintf(w, "%-28s count=%d", name, h.TotalCount())
+		for _, p := range latencyPercentiles {
+			fmt.Fprintf(w, " p%s=%s", formatPercentile(p), time.Duration(h.ValueAtQuantile(p)))
+		}
+		fmt.Fprintf(w, " max=%s\n", time.Duration(h.Max()))
+	}
+}
+
+// summaries return the percentiles of every histogram
+func (r *latencyRecorder) summaries() []latencyReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ms := func(v int64) float64 { return float64(v) / float64(time.Millisecond) }
+	summaries := make([]latencyReport, 0, len(r.names))
+	for _, name := range r.names {
+		h := r.histograms[name]
+		summaries = append(summaries, latencyReport{
+			Name:  name,
+			Count: h.TotalCount(),
+			P50:   ms(h.ValueAtQuantile(50)),
+			P90:   ms(h.ValueAtQuantile(90)),
+			P99:   ms(h.ValueAtQuantile(99)),
+			P999:  ms(h.ValueAtQuantile(99.9)),
+			Max:   ms(h.Max()),
+		})
+	}
+	return summaries
+}
+
+// ReportEvery write the report to w at every interval, forever
+func (r *latencyRecorder) ReportEvery(interval time.Duration, w io.Writer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.Report(w)
+	}
+}
+
+// formatPercentile turn 99.9 into "999" and 50 into "50"
+func formatPercentile(p float64) string {
+	return strings.Replace(fmt.Sprintf("%g", p), ".", "", -1)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/bclermont/grpctest/common"
+	"github.com/bclermont/grpctest/proto"
+)
+
+const (
+	kindUnary  = "unary"
+	kindClient = "client"
+	kindServer = "server"
+	kindBidi   = "bidi"
+)
+
+var (
+	loadKinds = []string{kindUnary, kindClient, kindServer, kindBidi}
+	// errTokenRefresh stop a bidi stream so it can be opened again with a fresh token
+	errTokenRefresh = errors.New("token refresh")
+)
+
+// maxLoadRate is the highest rate per RPC kind, the interval between operations must be at least 1ns
+const maxLoadRate = 1e9
+
+// LoadOptions describe how much load to generate for each RPC kind
+type LoadOptions struct {
+	Kinds       []string
+	Concurrency int
+	// Rate is the target number of operations per second for each kind, 0 means as fast as possible
+	Rate     float64
+	Duration time.Duration
+	// Count is the total number of operations for each kind, 0 means unlimited
+	Count int64
+	// Messages is the number of messages sent or received by a single stream operation
+	Messages int
+}
+
+func loadCommand() *cobra.Command {
+	var (
+		authContext func(context.Context) context.Context
+		client      grpctest.GrpcTestClient
+		log         *zap.Logger
+		opts        LoadOptions
+	)
+	cmd := &cobra.Command{
+		Use:         "load",
+		Short:       "Run concurrent workers for each RPC kind and print a summary",
+		Annotations: runAnnotations,
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			authContext, client, _, log, err = preUp()
+			if err != nil {
+				return
+			}
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return LoadTest(authContext, client, opts, log)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVar(&opts.Kinds, "kind", loadKinds, "RPC kinds to run: "+strings.Join(loadKinds, ", "))
+	flags.IntVar(&opts.Concurrency, "concurrency", 1, "number of concurrent workers per RPC kind")
+	flags.Float64Var(&opts.Rate, "rate", 0, "target operations per second per RPC kind, 0 for as fast as possible")
+	flags.DurationVar(&opts.Duration, "duration", 0, "stop after this duration, 0 for no limit")
+	flags.Int64Var(&opts.Count, "count", 0, "stop after this many operations per RPC kind, 0 for no limit")
+	flags.IntVar(&opts.Messages, "messages", 10, "number of messages per client or server stream operation")
+	return cmd
+}
+
+func (o LoadOptions) validate() error {
+	for _, kind := range o.Kinds {
+		if !stringInSlice(kind, loadKinds) {
+			return errors.Errorf("Unknown RPC kind %q", kind)
+		}
+	}
+	if o.Concurrency < 1 {
+		return errors.New("Concurrency must be at least 1")
+	}
+	if o.Rate < 0 || o.Rate > maxLoadRate {
+		return errors.Errorf("Rate must be between 0 and %g", float64(maxLoadRate))
+	}
+	if o.Messages < 1 {
+		return errors.New("Messages must be at least 1")
+	}
+	if o.Duration == 0 && o.Count == 0 {
+		return errors.New("Missing stop condition, set duration or count")
+	}
+	if o.Duration < 0 {
+		return errors.New("Duration can't be negative")
+	}
+	if o.Duration > 0 && o.Rate > 0 && o.Duration < time.Duration(float64(time.Second)/o.Rate) {
+		// the first operation start after one interval
+		return errors.Errorf("Duration %s is shorter than the interval between operations at rate %g", o.Duration, o.Rate)
+	}
+	return nil
+}
+
+// loadStats accumulate the result of all the workers of a RPC kind
+type loadStats struct {
+	kind       string
+	ops        int64
+	failed     int64
+	sent       int64
+	received   int64
+	reconnects int64
+
+	mu     sync.Mutex
+	errors map[codes.Code]int64
+}
+
+func (s *loadStats) fail(err error) {
+	atomic.AddInt64(&s.failed, 1)
+	s.mu.Lock()
+	s.errors[grpc.Code(err)]++
+	s.mu.Unlock()
+}
+
+// LoadTest run opts.Concurrency workers for each RPC kind until duration or count is reached or interrupted, then print a summary
+func LoadTest(authContext func(context.Context) context.Context, client grpctest.GrpcTestClient, opts LoadOptions, log *zap.Logger) error {
+	// an interrupt stop the workers like the end of the duration
+	var (
+		ctx      context.Context
+		cancelFn context.CancelFunc
+	)
+	if opts.Duration > 0 {
+		ctx, cancelFn = context.WithTimeout(shutdown, opts.Duration)
+	} else {
+		ctx, cancelFn = context.WithCancel(shutdown)
+	}
+	defer cancelFn()
+
+	var (
+		wg    sync.WaitGroup
+		stats = make([]*loadStats, 0, len(opts.Kinds))
+		start = time.Now()
+	)
+	for _, kind := range opts.Kinds {
+		st := runStats.get(kind)
+		stats = append(stats, st)
+		tokens := loadTokens(ctx, opts)
+		kLog := log.With(zap.String("kind", kind))
+		for i := 0; i < opts.Concurrency; i++ {
+			seq, err := common.NewSequencer()
+			if err != nil {
+				// stop the workers already started
+				cancelFn()
+				wg.Wait()
+				return errors.Wrap(err, "Can't start session")
+			}
+			w := &loadWorker{
+				authContext: authContext,
+				client:      client,
+				opts:        opts,
+				stats:       st,
+				tokens:      tokens,
+				seq:         seq,
+				log:         kLog.With(zap.Int("worker", i)),
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.run(ctx)
+			}()
+		}
+	}
+	log.Info("Load started", zap.Strings("kinds", opts.Kinds), zap.Int("concurrency", opts.Concurrency))
+	wg.Wait()
+	printLoadSummary(stats, time.Since(start))
+	return nil
+}
+
+// loadTokens return a channel that gives the permission to run one operation, following the target rate and count
+func loadTokens(ctx context.Context, opts LoadOptions) <-chan struct{} {
+	tokens := make(chan struct{})
+	go func() {
+		defer close(tokens)
+		var ticker *time.Ticker
+		if opts.Rate > 0 {
+			ticker = time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+			defer ticker.Stop()
+		}
+		for issued := int64(0); opts.Count == 0 || issued < opts.Count; issued++ {
+			if ticker != nil {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return tokens
+}
+
+type loadWorker struct {
+	authContext func(context.Context) context.Context
+	client      grpctest.GrpcTestClient
+	opts        LoadOptions
+	stats       *loadStats
+	tokens      <-chan struct{}
+	seq         *common.Sequencer
+	log         *zap.Logger
+}
+
+func (w *loadWorker) run(ctx context.Context) {
+	if w.stats.kind == kindBidi {
+		w.runBidi(ctx)
+		return
+	}
+	backoff := common.NewBackoff(backoffPolicy)
+	for range w.tokens {
+		var err error
+		switch w.stats.kind {
+		case kindUnary:
+			err = w.unary(ctx)
+		case kindClient:
+			err = w.clientStream(ctx)
+		case kindServer:
+			err = w.serverStream(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				// interrupted by the end of the test, not a failure
+				return
+			}
+			w.log.Debug("Operation failed", zap.Error(err))
+			w.stats.fail(err)
+			if err = backoff.Wait(ctx, w.log); err != nil {
+				w.log.Error("Stop worker", zap.Error(err))
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+		atomic.AddInt64(&w.stats.ops, 1)
+	}
+}
+
+func (w *loadWorker) unary(ctx context.Context) error {
+	req, err := newRequest(w.seq, time.Now())
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&w.stats.sent, 1)
+	start := time.Now()
+	resp, err := w.client.Unary(w.authContext(ctx), req)
+	if err != nil {
+		return err
+	}
+	verifyPayload(w.log, resp)
+	latencies.Record(latencyUnary, time.Since(start))
+	atomic.AddInt64(&w.stats.received, 1)
+	return nil
+}
+
+func (w *loadWorker) clientStream(ctx context.Context) error {
+	stream, err := w.client.ClientStream(w.authContext(ctx))
+	if err != nil {
+		return err
+	}
+	digest := common.NewDigest()
+	for i := 0; i < w.opts.Messages; i++ {
+		req, err := newRequest(w.seq, time.Now())
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(req); err != nil {
+			return err
+		}
+		digest.Add(req.Value, req.Payload)
+		atomic.AddInt64(&w.stats.sent, 1)
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	atomic.AddInt64(&w.stats.received, 1)
+	if echoCount > 0 && resp != nil {
+		return verifyAggregate(digest, resp)
+	}
+	return nil
+}
+
+func (w *loadWorker) serverStream(ctx context.Context) error {
+	ctx, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	req, err := newRequest(w.seq, time.Now())
+	if err != nil {
+		return err
+	}
+	// the server answer at its interval unless asked to echo, an operation would take minutes
+	ctx = withMetadata(w.authContext(ctx), map[string]string{common.MetadataEcho: strconv.Itoa(w.opts.Messages)})
+	start := time.Now()
+	stream, err := w.client.ServerStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&w.stats.sent, 1)
+	for i := 0; i < w.opts.Messages; i++ {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		observeResponse(w.log, resp)
+		if i == 0 {
+			latencies.Record(latencyFirstMessage, time.Since(start))
+		}
+		atomic.AddInt64(&w.stats.received, 1)
+	}
+	return nil
+}
+
+// runBidi keep a stream open and send one request per token, responses are counted as they come
+func (w *loadWorker) runBidi(ctx context.Context) {
+	backoff := common.NewBackoff(backoffPolicy)
+	for ctx.Err() == nil {
+		sCtx, cancelFn := context.WithCancel(ctx)
+		stream, err := w.client.BiDirectionalStream(w.authContext(sCtx))
+		if err != nil {
+			cancelFn()
+			if ctx.Err() != nil {
+				return
+			}
+			w.log.Debug("Can't open stream, try again", zap.Error(err))
+			w.stats.fail(err)
+			if err = backoff.Wait(ctx, w.log); err != nil {
+				w.log.Error("Stop worker", zap.Error(err))
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+		go func() {
+			defer cancelFn()
+			var lastReceived time.Time
+			for {
+				resp, err := stream.Recv()
+				if err != nil {
+					return
+				}
+				observeResponse(w.log, resp)
+				now := time.Now()
+				if !lastReceived.IsZero() {
+					latencies.Record(latencyInterArrival, now.Sub(lastReceived))
+				}
+				lastReceived = now
+				atomic.AddInt64(&w.stats.received, 1)
+			}
+		}()
+
+		err = w.bidiSend(sCtx, stream)
+		cancelFn()
+		if err == errTokenRefresh {
+			w.log.Debug("Token about to expire, reopen stream")
+			continue
+		}
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		w.log.Debug("Stream failed, reopen", zap.Error(err))
+		w.stats.fail(err)
+		countReconnect(kindBidi)
+		if err = backoff.Wait(ctx, w.log); err != nil {
+			w.log.Error("Stop worker", zap.Error(err))
+			return
+		}
+	}
+}
+
+func (w *loadWorker) bidiSend(ctx context.Context, stream grpctest.GrpcTest_BiDirectionalStreamClient) error {
+	refresh := tokenRefreshTimer()
+	defer refresh.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-refresh.C:
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+			return errTokenRefresh
+
+		case _, isOpen := <-w.tokens:
+			if !isOpen {
+				return stream.CloseSend()
+			}
+			req, err := newRequest(w.seq, time.Now())
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(req); err != nil {
+				return err
+			}
+			atomic.AddInt64(&w.stats.sent, 1)
+			atomic.AddInt64(&w.stats.ops, 1)
+		}
+	}
+}
+
+func printLoadSummary(stats []*loadStats, elapsed time.Duration) {
+	fmt.Fprintf(summaryOutput, "Load summary after %s\n", elapsed.Round(time.Millisecond))
+	for _, st := range stats {
+		fmt.Fprintf(summaryOutput, "%-7s ops=%d failed=%d sent=%d received=%d rate=%.1f/s\n",
+			st.kind, st.ops, st.failed, st.sent, st.received, float64(st.ops)/elapsed.Seconds())
+		codesList := make([]codes.Code, 0, len(st.errors))
+		for code := range st.errors {
+			codesList = append(codesList, code)
+		}
+		sort.Slice(codesList, func(i, j int) bool { return codesList[i] < codesList[j] })
+		for _, code := range codesList {
+			fmt.Fprintf(summaryOutput, "        %s=%d\n", code, st.errors[code])
+		}
+	}
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
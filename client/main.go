@@ -2,14 +2,17 @@ package main
 
 import (
 	"fmt"
-	"net"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"github.com/grpc-ecosystem/go-grpc-middleware/retry"
 	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -23,7 +26,17 @@ import (
 	"github.com/bclermont/grpctest/proto"
 )
 
-const keyServer = "server"
+const (
+	keyServer   = "server"
+	keyMetadata = "metadata"
+)
+
+var (
+	// backoffPolicy is the delay between reconnect attempts shared by the client commands
+	backoffPolicy common.BackoffPolicy
+	// clientConn is the connection opened by preUp, for the commands using other services
+	clientConn *grpc.ClientConn
+)
 
 func init() {
 	viper.SetDefault(keyServer, "localhost")
@@ -33,37 +46,118 @@ func preUp() (fn func(context.Context) context.Context, client grpctest.GrpcTest
 	var (
 		port   int
 		apiKey string
-		server = viper.GetString(keyServer)
 	)
 	port, apiKey, interval, log = common.Init()
+	// read after Init, which enable the environment variables
+	server := viper.GetString(keyServer)
 	if len(server) == 0 {
 		err = errors.Errorf("Missing %q", keyServer)
 		return
 	}
 
 	grpc_zap.ReplaceGrpcLogger(log)
+	grpc_prometheus.EnableClientHandlingTimeHistogram()
+	common.StartMetrics(log)
 
 	retryOption := grpc_retry.WithPerRetryTimeout(time.Minute * 5)
 	retryUnary := grpc_retry.UnaryClientInterceptor(retryOption)
 	retryStream := grpc_retry.StreamClientInterceptor(retryOption)
 
-	clientConn, err := grpc.Dial(
-		net.JoinHostPort(server, strconv.Itoa(port)),
-		grpc.WithInsecure(),
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                common.IdlePing,
-			Timeout:             common.IdlePingTimeout,
-			PermitWithoutStream: true,
-		}),
-		grpc.WithUnaryInterceptor(retryUnary),
-		grpc.WithStreamInterceptor(retryStream),
+	creds, err := common.ClientCredentials()
+	if err != nil {
+		return
+	}
+	transportOption := grpc.WithInsecure()
+	if creds != nil {
+		transportOption = grpc.WithTransportCredentials(creds)
+	}
+	if payloads, err = common.LoadPayloadGenerator(); err != nil {
+		return
+	}
+	if backoffPolicy, err = common.LoadBackoffPolicy(); err != nil {
+		return
+	}
+	maxMessageSize, err := common.MaxMessageSize()
+	if err != nil {
+		return
+	}
+	compressor := viper.GetString(keyCompressor)
+	if err = common.CheckCompressor(compressor); err != nil {
+		return
+	}
+	countDecompression()
+	callOptions := compressorOptions(compressor)
+	if maxMessageSize > 0 {
+		callOptions = append(callOptions, grpc.MaxCallRecvMsgSize(maxMessageSize), grpc.MaxCallSendMsgSize(maxMessageSize))
+	}
+
+	var balancerOptions []grpc.DialOption
+	if target, balancerOptions, err = dialTarget(server, port, log); err != nil {
+		return
+	}
+	clientConn, err = grpc.Dial(
+		target,
+		append(balancerOptions,
+			transportOption,
+			grpc.WithContextDialer(common.DialContext),
+			grpc.WithDefaultCallOptions(callOptions...),
+			grpc.WithStatsHandler(compression),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                common.IdlePing,
+				Timeout:             common.IdlePingTimeout,
+				PermitWithoutStream: true,
+			}),
+			grpc.WithUnaryInterceptor(
+				grpc_middleware.ChainUnaryClient(
+					DeadlineUnaryClientInterceptor(viper.GetDuration(keyDeadline)),
+					grpc_prometheus.UnaryClientInterceptor,
+					retryUnary,
+					BackendUnaryClientInterceptor(),
+				),
+			),
+			grpc.WithStreamInterceptor(
+				grpc_middleware.ChainStreamClient(
+					DeadlineStreamClientInterceptor(viper.GetDuration(keyStreamDeadline)),
+					grpc_prometheus.StreamClientInterceptor,
+					common.ActiveStreamClientInterceptor(),
+					retryStream,
+					BackendStreamClientInterceptor(),
+				),
+			),
+		)...,
 	)
 	if err != nil {
 		return
 	}
 
+	extraMD, err := parseMetadata(viper.GetStringSlice(keyMetadata))
+	if err != nil {
+		return
+	}
+	if echoCount = viper.GetInt(keyEcho); echoCount > 0 {
+		extraMD = metadata.Join(extraMD, metadata.Pairs(common.MetadataEcho, strconv.Itoa(echoCount)))
+	}
+
+	token := func() (string, error) { return apiKey, nil }
+	if common.AuthMode() == common.AuthModeJWT {
+		if tokenSource, err = newJWTSource(common.LoadJWTConfig()); err != nil {
+			return
+		}
+		token = func() (string, error) {
+			val, _, err := tokenSource.Token()
+			return val, err
+		}
+	}
+
 	fn = func(ctx context.Context) context.Context {
-		md := metadata.Pairs("authorization", fmt.Sprintf("%s %v", grpctest.Scheme, apiKey))
+		val, err := token()
+		if err != nil {
+			log.Error("Can't get token", zap.Error(err))
+		}
+		md := metadata.Join(
+			metadata.Pairs("authorization", fmt.Sprintf("%s %v", grpctest.Scheme, val)),
+			extraMD,
+		)
 		return metautils.NiceMD(md).ToOutgoing(ctx)
 	}
 
@@ -71,18 +165,115 @@ func preUp() (fn func(context.Context) context.Context, client grpctest.GrpcTest
 	return
 }
 
+// printSummary write the results collected by all the commands
+func printSummary(w io.Writer) {
+	latencies.Report(w)
+	printSequenceSummary(w)
+	printEchoSummary(w)
+	printBackendSummary(w)
+	printCompressionSummary(w, viper.GetString(keyCompressor))
+}
+
+// parseMetadata turn a list of key=value into metadata
+func parseMetadata(pairs []string) (metadata.MD, error) {
+	md := metadata.MD{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("Invalid metadata %q, expected key=value", pair)
+		}
+		key := strings.ToLower(pair[:i])
+		md[key] = append(md[key], pair[i+1:])
+	}
+	return md, nil
+}
+
 func main() {
+	var (
+		latencyInterval time.Duration
+		reportOpts      ReportOptions
+	)
 	rootCmd := &cobra.Command{
 		Use:   "client",
 		Short: "gRPC test client",
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			if _, ok := cmd.Annotations[annotationRun]; !ok {
+				if len(reportOpts.JSON) > 0 || len(reportOpts.JUnit) > 0 {
+					return errors.Errorf("The %s command doesn't write a run report", cmd.Name())
+				}
+				return nil
+			}
+			if reportOpts.JSON == "-" && reportOpts.JUnit == "-" {
+				return errors.New("Only one report can be written to stdout")
+			}
+			if reportOpts.toStdout() {
+				// keep stdout a valid JSON or XML document
+				summaryOutput = os.Stderr
+			}
+			runCommand, runStart = cmd.Name(), time.Now()
+			if latencyInterval > 0 {
+				go latencies.ReportEvery(latencyInterval, summaryOutput)
+			}
+			return nil
+		},
 	}
 	rootCmd.Long = rootCmd.Short
+	common.PayloadFlags(rootCmd.PersistentFlags())
+	common.BackoffFlags(rootCmd.PersistentFlags())
+	rootCmd.PersistentFlags().StringSlice(keyMetadata, nil, "extra metadata sent with every call, as key=value")
+	viper.BindPFlag(keyMetadata, rootCmd.PersistentFlags().Lookup(keyMetadata))
+	rootCmd.PersistentFlags().StringSlice(keyTargets, nil, "backends to balance between, as host:port=weight, or a single name resolved by gRPC like dns:///host:port")
+	viper.BindPFlag(keyTargets, rootCmd.PersistentFlags().Lookup(keyTargets))
+	rootCmd.PersistentFlags().String("targets-file", "", "file listing a backend per line, reloaded when it change")
+	viper.BindPFlag(keyTargetsFile, rootCmd.PersistentFlags().Lookup("targets-file"))
+	rootCmd.PersistentFlags().String(keyBalancer, balancerPickFirst, "balancing policy between the targets: "+strings.Join(balancers, ", "))
+	viper.BindPFlag(keyBalancer, rootCmd.PersistentFlags().Lookup(keyBalancer))
+	rootCmd.PersistentFlags().String(keyCompressor, "", "compress the requests: "+strings.Join(common.Compressors(), ", ")+" or identity")
+	viper.BindPFlag(keyCompressor, rootCmd.PersistentFlags().Lookup(keyCompressor))
+	rootCmd.PersistentFlags().Duration(keyDeadline, 0, "timeout of every unary call, 0 for none")
+	viper.BindPFlag(keyDeadline, rootCmd.PersistentFlags().Lookup(keyDeadline))
+	rootCmd.PersistentFlags().Duration("stream-deadline", 0, "timeout of every stream, from its opening to its end, 0 for none")
+	viper.BindPFlag(keyStreamDeadline, rootCmd.PersistentFlags().Lookup("stream-deadline"))
+	rootCmd.PersistentFlags().Int(keyEcho, 0, "ask the server to echo requests, the value is the number of echoes of a server stream")
+	viper.BindPFlag(keyEcho, rootCmd.PersistentFlags().Lookup(keyEcho))
+	rootCmd.PersistentFlags().DurationVar(&latencyInterval, "latency-interval", 0, "print latency percentiles at this interval, 0 to print only at exit")
+	rootCmd.PersistentFlags().StringVar(&reportOpts.JSON, "report-json", "", "write a JSON report of the run to this file, - for stdout")
+	rootCmd.PersistentFlags().StringVar(&reportOpts.JUnit, "report-junit", "", "write a JUnit XML report of the run to this file, - for stdout")
+	rootCmd.PersistentFlags().Float64Var(&reportOpts.MaxErrorRate, "max-error-rate", 1, "fail the run when the ratio of failed operations of a RPC kind is above this")
+	rootCmd.PersistentFlags().DurationVar(&reportOpts.MaxP99, "max-p99", 0, "fail the run when the 99th percentile of a latency is above this, 0 for no limit")
 	rootCmd.AddCommand(bidiCommand())
+	rootCmd.AddCommand(callCommand())
+	rootCmd.AddCommand(certsCommand())
 	rootCmd.AddCommand(clientCommand())
+	rootCmd.AddCommand(healthCommand())
+	rootCmd.AddCommand(jwksCommand())
+	rootCmd.AddCommand(loadCommand())
+	rootCmd.AddCommand(proxyCommand())
+	rootCmd.AddCommand(scenarioCommand())
 	rootCmd.AddCommand(serverCommand())
 	rootCmd.AddCommand(unaryCommand())
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+	handleSignals()
+	err := rootCmd.Execute()
+	if err != nil {
+		fmt.Fprintln(summaryOutput, err.Error())
+	}
+	thresholdsPassed := true
+	if len(runCommand) > 0 {
+		// cobra skip the post run hooks on error, the summary is printed whatever the outcome
+		printSummary(summaryOutput)
+		report := newRunReport(reportOpts, err)
+		if wErr := report.write(reportOpts); wErr != nil {
+			fmt.Fprintln(summaryOutput, "Can't write report:", wErr.Error())
+			os.Exit(exitError)
+		}
+		thresholdsPassed = report.thresholdsPassed()
+	}
+	switch {
+	case err != nil:
+		os.Exit(exitError)
+	case !thresholdsPassed:
+		os.Exit(exitThresholds)
+	case anomalies():
+		os.Exit(exitAnomalies)
 	}
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpctest_client_reconnects_total",
+			Help: "Total number of times a client loop had to open its stream again.",
+		}, []string{"kind"})
+	backendCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpctest_client_backend_calls_total",
+			Help: "Total number of unary calls and streams sent to every backend.",
+		}, []string{"backend", "type"})
+)
+
+func init() {
+	prometheus.MustRegister(reconnects, backendCalls)
+}
+
+// countReconnect count a reconnect of a client loop of kind, in the metrics and the run report
+func countReconnect(kind string) {
+	reconnects.WithLabelValues(kind).Inc()
+	atomic.AddInt64(&runStats.get(kind).reconnects, 1)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+// proxyChunkSize is the biggest chunk of data forwarded at once, it's our "packet"
+const proxyChunkSize = 16 * 1024
+
+// ProxyOptions describe the impairments applied by the proxy, in both directions
+type ProxyOptions struct {
+	Listen string
+	Target string
+	// Latency is added to every chunk, plus or minus a random Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bandwidth is the maximum number of bytes per second in each direction, 0 for no limit
+	Bandwidth int64
+	// StallEvery and StallDuration periodically stop forwarding without closing the connection
+	StallEvery    time.Duration
+	StallDuration time.Duration
+	// HalfOpenAfter silently stop forwarding anything while keeping the connection open
+	HalfOpenAfter time.Duration
+	// ResetAfter abruptly reset the connection after a random duration between half and one and a half this value
+	ResetAfter time.Duration
+}
+
+func proxyCommand() *cobra.Command {
+	var opts ProxyOptions
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Forward connections to the server while simulating a bad network",
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			return opts.validate()
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			log, err := zap.NewDevelopment()
+			if err != nil {
+				return err
+			}
+			return RunProxy(opts, log)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&opts.Listen, "listen", "localhost:8842", "local address accepting connections")
+	flags.StringVar(&opts.Target, "target", "localhost:8841", "server address")
+	flags.DurationVar(&opts.Latency, "latency", 0, "latency added to every chunk of data")
+	flags.DurationVar(&opts.Jitter, "jitter", 0, "random variation of the latency")
+	flags.Int64Var(&opts.Bandwidth, "bandwidth", 0, "bytes per second in each direction, 0 for no limit")
+	flags.DurationVar(&opts.StallEvery, "stall-every", 0, "stop forwarding periodically, 0 to never stall")
+	flags.DurationVar(&opts.StallDuration, "stall-duration", time.Second, "how long a stall last")
+	flags.DurationVar(&opts.HalfOpenAfter, "half-open-after", 0, "stop forwarding but keep connections open after this duration, 0 to disable")
+	flags.DurationVar(&opts.ResetAfter, "reset-after", 0, "reset connections after about this duration, 0 to disable")
+	return cmd
+}
+
+func (o ProxyOptions) validate() error {
+	if o.Latency < 0 || o.Jitter < 0 {
+		return errors.New("Latency and jitter can't be negative")
+	}
+	if o.Bandwidth < 0 {
+		return errors.New("Bandwidth can't be negative")
+	}
+	if o.StallEvery < 0 || o.StallDuration < 0 {
+		return errors.New("Stall period and duration can't be negative")
+	}
+	if o.StallEvery > 0 && o.StallDuration >= o.StallEvery {
+		// the proxy would stall all the time
+		return errors.Errorf("Stall duration %s must be shorter than the stall period %s", o.StallDuration, o.StallEvery)
+	}
+	if o.HalfOpenAfter < 0 || o.ResetAfter < 0 {
+		return errors.New("Half-open and reset durations can't be negative")
+	}
+	return nil
+}
+
+// RunProxy accept connections forever and forward them to the target with impairments
+func RunProxy(opts ProxyOptions, log *zap.Logger) error {
+	lis, err := common.Listen(opts.Listen)
+	if err != nil {
+		return err
+	}
+	log.Info("Listen proxy", zap.String("address", lis.Addr().String()), zap.String("target", opts.Target))
+	go func() {
+		<-shutdown.Done()
+		lis.Close()
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if shutdown.Err() != nil {
+				log.Info("Interrupted, stop proxy")
+				return nil
+			}
+			return err
+		}
+		go proxyConn(conn, opts, log.With(zap.Stringer("client", conn.RemoteAddr())))
+	}
+}
+
+func proxyConn(client net.Conn, opts ProxyOptions, log *zap.Logger) {
+	server, err := common.DialContext(shutdown, opts.Target)
+	if err != nil {
+		log.Error("Can't connect to target", zap.Error(err))
+		client.Close()
+		return
+	}
+	log.Debug("Proxy connection opened")
+
+	var (
+		start     = time.Now()
+		done      = make(chan struct{})
+		closeOnce sync.Once
+	)
+	closeBoth := func(reset bool) {
+		closeOnce.Do(func() {
+			if reset {
+				for _, c := range []net.Conn{client, server} {
+					if tcp, ok := c.(*net.TCPConn); ok {
+						tcp.SetLinger(0)
+					}
+				}
+			}
+			client.Close()
+			server.Close()
+			close(done)
+		})
+	}
+
+	if opts.ResetAfter > 0 {
+		after := opts.ResetAfter/2 + time.Duration(rand.Int63n(int64(opts.ResetAfter)+1))
+		timer := time.AfterFunc(after, func() {
+			log.Info("Reset connection", zap.Duration("after", after))
+			closeBoth(true)
+		})
+		defer timer.Stop()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, dir := range []struct {
+		name     string
+		src, dst net.Conn
+	}{
+		{"upstream", client, server},
+		{"downstream", server, client},
+	} {
+		p := &impairedPipe{opts: opts, start: start, done: done, log: log.With(zap.String("direction", dir.name))}
+		go func(src, dst net.Conn) {
+			defer wg.Done()
+			p.run(src, dst)
+			closeBoth(false)
+		}(dir.src, dir.dst)
+	}
+	wg.Wait()
+	log.Debug("Proxy connection closed", zap.Duration("duration", time.Since(start)))
+}
+
+// chunk is some data read from a connection, to be written when it's due
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+// impairedPipe forward one direction of a connection
+type impairedPipe struct {
+	opts  ProxyOptions
+	start time.Time
+	done  <-chan struct{}
+	log   *zap.Logger
+}
+
+func (p *impairedPipe) run(src, dst net.Conn) {
+	chunks := make(chan chunk, 1024)
+	go func() {
+		defer close(chunks)
+		var lastDue time.Time
+		for {
+			buf := make([]byte, proxyChunkSize)
+			n, err := src.Read(buf)
+			if n > 0 {
+				due := time.Now().Add(p.delay())
+				// keep the order of the stream, as TCP does
+				if due.Before(lastDue) {
+					due = lastDue
+				}
+				lastDue = due
+				select {
+				case chunks <- chunk{data: buf[:n], due: due}:
+				case <-p.done:
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					p.log.Debug("Read failed", zap.Error(err))
+				}
+				return
+			}
+		}
+	}()
+
+	halfOpen := false
+	for c := range chunks {
+		if p.opts.HalfOpenAfter > 0 && time.Since(p.start) >= p.opts.HalfOpenAfter {
+			if !halfOpen {
+				halfOpen = true
+				p.log.Info("Connection is now half-open, drop everything")
+			}
+			continue
+		}
+		if !p.wait(c.due) {
+			return
+		}
+		if _, err := dst.Write(c.data); err != nil {
+			p.log.Debug("Write failed", zap.Error(err))
+			return
+		}
+		if p.opts.Bandwidth > 0 {
+			if !p.sleep(time.Duration(int64(len(c.data)) * int64(time.Second) / p.opts.Bandwidth)) {
+				return
+			}
+		}
+	}
+}
+
+func (p *impairedPipe) delay() time.Duration {
+	d := p.opts.Latency
+	if p.opts.Jitter > 0 {
+		d += time.Duration(rand.Int63n(2*int64(p.opts.Jitter)+1)) - p.opts.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// wait until the chunk is due and no stall is in progress, it return false if the connection is closed first
+func (p *impairedPipe) wait(due time.Time) bool {
+	if !p.sleep(time.Until(due)) {
+		return false
+	}
+	if p.opts.StallEvery > 0 {
+		// stall during the last StallDuration of every StallEvery period
+		inPeriod := time.Since(p.start) % p.opts.StallEvery
+		if stallStart := p.opts.StallEvery - p.opts.StallDuration; inPeriod >= stallStart {
+			p.log.Debug("Stall", zap.Duration("remaining", p.opts.StallEvery-inPeriod))
+			return p.sleep(p.opts.StallEvery - inPeriod)
+		}
+	}
+	return true
+}
+
+func (p *impairedPipe) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.done:
+		return false
+	}
+}
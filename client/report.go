@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/codes"
+)
+
+// exitThresholds is the exit code when the run report fail a threshold
+const exitThresholds = 3
+
+var (
+	// runStats accumulate the counts of the current command by RPC kind, for the run report
+	runStats = &kindStats{stats: make(map[string]*loadStats)}
+	// runCommand and runStart describe the current command, target is the server address it use
+	runCommand string
+	runStart   time.Time
+	target     string
+)
+
+// annotationRun mark the commands running RPCs, they print the summary and write the run report
+const annotationRun = "grpctest_run"
+
+// runAnnotations is the annotations of the commands running RPCs
+var runAnnotations = map[string]string{annotationRun: "true"}
+
+// summaryOutput is where the human readable summary is written, stderr when a report is written to stdout
+var summaryOutput io.Writer = os.Stdout
+
+// ReportOptions configure the run report and the thresholds deciding if the run passed
+type ReportOptions struct {
+	JSON  string
+	JUnit string
+	// MaxErrorRate is the maximum ratio of failed operations for each RPC kind
+	MaxErrorRate float64
+	// MaxP99 is the maximum 99th percentile of every latency, 0 for no limit
+	MaxP99 time.Duration
+}
+
+// toStdout tell if a report is written to stdout
+func (o ReportOptions) toStdout() bool {
+	return o.JSON == "-" || o.JUnit == "-"
+}
+
+// kindStats keep the stats of every RPC kind, in the order they are used
+type kindStats struct {
+	mu    sync.Mutex
+	kinds []string
+	stats map[string]*loadStats
+}
+
+func (k *kindStats) get(kind string) *loadStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st, ok := k.stats[kind]
+	if !ok {
+		st = &loadStats{kind: kind, errors: make(map[codes.Code]int64)}
+		k.stats[kind] = st
+		k.kinds = append(k.kinds, kind)
+	}
+	return st
+}
+
+func (k *kindStats) all() []*loadStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	all := make([]*loadStats, len(k.kinds))
+	for i, kind := range k.kinds {
+		all[i] = k.stats[kind]
+	}
+	return all
+}
+
+type runReport struct {
+	Command        string             `json:"command"`
+	Target         string             `json:"target"`
+	Start          time.Time          `json:"start"`
+	Duration       float64            `json:"duration_seconds"`
+	Passed         bool               `json:"passed"`
+	Error          string             `json:"error,omitempty"`
+	Kinds          []kindReport       `json:"kinds"`
+	Latencies      []latencyReport    `json:"latencies"`
+	Sequence       sequenceReport     `json:"sequence"`
+	Corrupted      uint64             `json:"corrupted"`
+	EchoMismatches uint64             `json:"echo_mismatches"`
+	Backends       []backendReport    `json:"backends,omitempty"`
+	Compression    *compressionReport `json:"compression,omitempty"`
+	Checks         []reportCheck      `json:"checks"`
+}
+
+type kindReport struct {
+	Kind       string           `json:"kind"`
+	Operations int64            `json:"operations"`
+	Failed     int64            `json:"failed"`
+	ErrorRate  float64          `json:"error_rate"`
+	Sent       int64            `json:"sent"`
+	Received   int64            `json:"received"`
+	Reconnects int64            `json:"reconnects"`
+	Errors     map[string]int64 `json:"errors"`
+}
+
+type latencyReport struct {
+	Name  string  `json:"name"`
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	P999  float64 `json:"p999_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+type sequenceReport struct {
+	Streams    int    `json:"streams"`
+	Received   uint64 `json:"received"`
+	Gaps       uint64 `json:"gaps"`
+	Lost       uint64 `json:"lost"`
+	Reordered  uint64 `json:"reordered"`
+	Duplicates uint64 `json:"duplicates"`
+}
+
+// reportCheck is the outcome of a threshold, a JUnit test case
+type reportCheck struct {
+	Name    string  `json:"name"`
+	Passed  bool    `json:"passed"`
+	Message string  `json:"message,omitempty"`
+	Time    float64 `json:"-"`
+}
+
+// newRunReport collect the stats of the command, runErr is the error it returned, and check the thresholds
+func newRunReport(opts ReportOptions, runErr error) *runReport {
+	elapsed := time.Since(runStart)
+	r := &runReport{
+		Command:        runCommand,
+		Target:         target,
+		Start:          runStart,
+		Duration:       elapsed.Seconds(),
+		Latencies:      latencies.summaries(),
+		Corrupted:      atomic.LoadUint64(&corrupted),
+		EchoMismatches: atomic.LoadUint64(&echoMismatches),
+	}
+	if backends.enabled {
+		r.Backends = backends.reports()
+	}
+	r.Compression = compression.report(viper.GetString(keyCompressor))
+	check := func(name string, passed bool, format string, args ...interface{}) {
+		c := reportCheck{Name: name, Passed: passed, Time: elapsed.Seconds()}
+		if !passed {
+			c.Message = fmt.Sprintf(format, args...)
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+	check("run", runErr == nil, "%v", runErr)
+
+	for _, st := range runStats.all() {
+		kr := kindReport{
+			Kind:       st.kind,
+			Operations: atomic.LoadInt64(&st.ops),
+			Failed:     atomic.LoadInt64(&st.failed),
+			Sent:       atomic.LoadInt64(&st.sent),
+			Received:   atomic.LoadInt64(&st.received),
+			Reconnects: atomic.LoadInt64(&st.reconnects),
+			Errors:     make(map[string]int64),
+		}
+		st.mu.Lock()
+		for code, n := range st.errors {
+			kr.Errors[code.String()] = n
+		}
+		st.mu.Unlock()
+		if attempts := kr.Operations + kr.Failed; attempts > 0 {
+			kr.ErrorRate = float64(kr.Failed) / float64(attempts)
+		}
+		r.Kinds = append(r.Kinds, kr)
+		check(kr.Kind+" error rate", kr.ErrorRate <= opts.MaxErrorRate,
+			"error rate %.4f is above %.4f", kr.ErrorRate, opts.MaxErrorRate)
+	}
+
+	if opts.MaxP99 > 0 {
+		for _, l := range r.Latencies {
+			p99 := time.Duration(l.P99 * float64(time.Millisecond))
+			check(l.Name+" p99", p99 <= opts.MaxP99, "p99 %s is above %s", p99, opts.MaxP99)
+		}
+	}
+
+	streams, stats := sequences.Total()
+	r.Sequence.Streams = streams
+	r.Sequence.Received = stats.Received
+	r.Sequence.Gaps = stats.Gaps
+	r.Sequence.Lost = stats.Lost
+	r.Sequence.Reordered = stats.Reordered
+	r.Sequence.Duplicates = stats.Duplicates
+	check("integrity", !anomalies(), "%d lost, %d reordered, %d duplicated, %d corrupted messages and %d echo mismatches",
+		r.Sequence.Lost, r.Sequence.Reordered, r.Sequence.Duplicates, r.Corrupted, r.EchoMismatches)
+
+	r.Passed = true
+	for _, c := range r.Checks {
+		r.Passed = r.Passed && c.Passed
+	}
+	return r
+}
+
+// thresholdsPassed tell if the checks other than the run error and the integrity passed
+func (r *runReport) thresholdsPassed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed && c.Name != "run" && c.Name != "integrity" {
+			return false
+		}
+	}
+	return true
+}
+
+// write the report to the files configured in opts, "-" is stdout
+func (r *runReport) write(opts ReportOptions) error {
+	if len(opts.JSON) > 0 {
+		if err := writeReport(opts.JSON, r.writeJSON); err != nil {
+			return err
+		}
+	}
+	if len(opts.JUnit) > 0 {
+		if err := writeReport(opts.JUnit, r.writeJUnit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeReport(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (r *runReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type junitSuite struct {
+	XMLName    xml.Name        `xml:"testsuite"`
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Time       float64         `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitCase     `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+func (r *runReport) writeJUnit(w io.Writer) error {
+	suite := junitSuite{
+		Name:      "grpctest " + r.Command,
+		Tests:     len(r.Checks),
+		Time:      r.Duration,
+		Timestamp: r.Start.Format(time.RFC3339),
+		Properties: []junitProperty{
+			{Name: "target", Value: r.Target},
+		},
+	}
+	for _, k := range r.Kinds {
+		errs := make([]string, 0, len(k.Errors))
+		for code, n := range k.Errors {
+			errs = append(errs, fmt.Sprintf("%s:%d", code, n))
+		}
+		sort.Strings(errs)
+		suite.Properties = append(suite.Properties, junitProperty{
+			Name: k.Kind,
+			Value: fmt.Sprintf("operations=%d failed=%d sent=%d received=%d reconnects=%d errors=%s",
+				k.Operations, k.Failed, k.Sent, k.Received, k.Reconnects, strings.Join(errs, ",")),
+		})
+	}
+	if c := r.Compression; c != nil {
+		suite.Properties = append(suite.Properties, junitProperty{
+			Name: "compression",
+			Value: fmt.Sprintf("compressor=%s sent=%d sent_wire=%d received=%d received_wire=%d",
+				c.Compressor, c.Sent, c.SentWire, c.Received, c.ReceivedWire),
+		})
+	}
+	for _, b := range r.Backends {
+		suite.Properties = append(suite.Properties, junitProperty{
+			Name:  "backend " + b.Backend,
+			Value: fmt.Sprintf("unary=%d streams=%d", b.Unary, b.Streams),
+		})
+	}
+	for _, c := range r.Checks {
+		tc := junitCase{Name: c.Name, ClassName: "grpctest." + r.Command, Time: c.Time}
+		if !c.Passed {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: c.Message}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+
+	"github.com/bclermont/grpctest/common"
+	"github.com/bclermont/grpctest/proto"
+)
+
+// Scenario step actions
+const (
+	actionOpen      = "open"
+	actionSend      = "send"
+	actionExpect    = "expect"
+	actionClose     = "close"
+	actionUnary     = "unary"
+	actionSleep     = "sleep"
+	actionReconnect = "reconnect"
+
+	// defaultWithin bound the wait of the expect and close steps
+	defaultWithin = time.Second * 10
+)
+
+// scenario is a sequence of steps run by a single client
+type scenario struct {
+	Name  string         `yaml:"name"`
+	Steps []scenarioStep `yaml:"steps"`
+}
+
+// scenarioStep is an action on the current stream, or a unary call, with its assertions
+type scenarioStep struct {
+	// Action is open, send, expect, close, unary, sleep or reconnect
+	Action string `yaml:"action"`
+	// Kind of the stream opened: client, server or bidi
+	Kind string `yaml:"kind,omitempty"`
+	// Count is the number of messages sent or unary calls, 1 by default
+	Count int `yaml:"count,omitempty"`
+	// Rate is the number of messages or calls per second, 0 for as fast as possible
+	Rate float64 `yaml:"rate,omitempty"`
+	// Responses is the number of responses expected since the stream was opened
+	Responses int `yaml:"responses,omitempty"`
+	// Within bound the wait of expect and close, 10s by default
+	Within time.Duration `yaml:"within,omitempty"`
+	// Code is the status code expected from unary calls, or ending the stream on expect and close
+	Code string `yaml:"code,omitempty"`
+	// Duration of a sleep
+	Duration time.Duration `yaml:"duration,omitempty"`
+	// Metadata is sent when opening the stream or with the unary calls, to inject faults for example
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	// Compressor of the requests of the stream opened or of the unary calls, instead of --compressor
+	Compressor string `yaml:"compressor,omitempty"`
+	// Deadline of the stream opened or of each unary call, instead of --stream-deadline and --deadline
+	Deadline time.Duration `yaml:"deadline,omitempty"`
+
+	code codes.Code
+}
+
+func (s *scenario) init() error {
+	if len(s.Steps) == 0 {
+		return errors.New("Scenario without steps")
+	}
+	// open is the kind of the stream open before each step
+	var open string
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if err := step.init(open); err != nil {
+			return errors.Wrapf(err, "Step %d", i+1)
+		}
+		switch step.Action {
+		case actionOpen:
+			open = step.Kind
+		case actionClose:
+			open = ""
+		}
+	}
+	return nil
+}
+
+// init check the step and set its defaults, open is the kind of the stream open before it
+func (step *scenarioStep) init(open string) error {
+	switch step.Action {
+	case actionOpen:
+		if step.Kind != kindClient && step.Kind != kindServer && step.Kind != kindBidi {
+			return errors.Errorf("Can't open a stream of kind %q", step.Kind)
+		}
+	case actionExpect:
+		if open == kindClient && (step.Responses > 0 || len(step.Code) > 0) {
+			// the response and the status of a client stream only come once it's closed
+			return errors.New("A client stream answer when closed, expect its code on the close step")
+		}
+	case actionSend, actionUnary:
+		if step.Count == 0 {
+			step.Count = 1
+		}
+		if step.Count < 0 || step.Rate < 0 {
+			return errors.New("Count and rate can't be negative")
+		}
+		if step.Rate > maxLoadRate {
+			return errors.Errorf("Rate can't be above %g", float64(maxLoadRate))
+		}
+	case actionSleep:
+		if step.Duration <= 0 {
+			return errors.New("Missing sleep duration")
+		}
+	case actionClose, actionReconnect:
+	default:
+		return errors.Errorf("Unknown action %q", step.Action)
+	}
+	if step.Within == 0 {
+		step.Within = defaultWithin
+	}
+	if step.Within < 0 {
+		return errors.New("Within can't be negative")
+	}
+	if step.Deadline < 0 {
+		return errors.New("Deadline can't be negative")
+	}
+	if err := common.CheckCompressor(step.Compressor); err != nil {
+		return err
+	}
+	if len(step.Code) > 0 {
+		code, err := common.ParseCode(step.Code)
+		if err != nil {
+			return err
+		}
+		step.code = code
+	}
+	return nil
+}
+
+func parseScenario(data []byte) (*scenario, error) {
+	s := &scenario{}
+	// YAML is a superset of JSON, both formats are accepted
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, errors.Wrap(err, "Can't parse scenario")
+	}
+	return s, s.init()
+}
+
+func loadScenario(path string) (*scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read scenario")
+	}
+	return parseScenario(data)
+}
+
+func scenarioCommand() *cobra.Command {
+	var (
+		authContext func(context.Context) context.Context
+		client      grpctest.GrpcTestClient
+		log         *zap.Logger
+	)
+	return &cobra.Command{
+		Use:         "run SCENARIO...",
+		Short:       "Run the steps of YAML or JSON scenario files",
+		Annotations: runAnnotations,
+		Args:        cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			authContext, client, _, log, err = preUp()
+			return
+		},
+		RunE: func(_ *cobra.Command, args []string) error {
+			for _, path := range args {
+				s, err := loadScenario(path)
+				if err != nil {
+					return errors.Wrap(err, path)
+				}
+				if err = RunScenario(authContext, client, s, log.With(zap.String("scenario", s.Name))); err != nil {
+					return errors.Wrapf(err, "Scenario %q", s.Name)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// scenarioRunner hold the state of a running scenario
+type scenarioRunner struct {
+	authContext func(context.Context) context.Context
+	client      grpctest.GrpcTestClient
+	seq         *common.Sequencer
+	log         *zap.Logger
+	// stream is the current stream, nil when none is open
+	stream *scenarioStream
+}
+
+// RunScenario run the steps of s in order, it stop at the first failed assertion
+func RunScenario(authContext func(context.Context) context.Context, client grpctest.GrpcTestClient, s *scenario, log *zap.Logger) error {
+	seq, err := common.NewSequencer()
+	if err != nil {
+		return err
+	}
+	r := &scenarioRunner{authContext: authContext, client: client, seq: seq, log: log}
+	defer func() {
+		if r.stream != nil {
+			r.stream.cancelFn()
+		}
+	}()
+
+	log.Info("Scenario started", zap.Int("steps", len(s.Steps)))
+	for i, step := range s.Steps {
+		if shutdown.Err() != nil {
+			log.Info("Interrupted, stop scenario")
+			return nil
+		}
+		sLog := log.With(zap.Int("step", i+1), zap.String("action", step.Action))
+		sLog.Info("Run step")
+		if err := r.run(step, sLog); err != nil {
+			if shutdown.Err() != nil {
+				log.Info("Interrupted, stop scenario")
+				return nil
+			}
+			return errors.Wrapf(err, "Step %d %s", i+1, step.Action)
+		}
+	}
+	if err := r.closeStream(scenarioStep{Within: defaultWithin}); err != nil {
+		return errors.Wrap(err, "Close the last stream")
+	}
+	log.Info("Scenario passed")
+	return nil
+}
+
+func (r *scenarioRunner) run(step scenarioStep, log *zap.Logger) error {
+	switch step.Action {
+	case actionOpen:
+		if r.stream != nil {
+			return errors.Errorf("A %s stream is already open", r.stream.kind)
+		}
+		return r.open(step.Kind, step.Metadata, step.Compressor, step.Deadline, log)
+	case actionReconnect:
+		if r.stream == nil {
+			return errors.New("No stream to reconnect")
+		}
+		kind, md, compressor, deadline := r.stream.kind, r.stream.metadata, r.stream.compressor, r.stream.deadline
+		r.stream.cancelFn()
+		if kind != kindClient {
+			// a client stream has no receiver to notice the cancel
+			<-r.stream.done
+		}
+		r.stream = nil
+		countReconnect(kind)
+		return r.open(kind, md, compressor, deadline, log)
+	case actionSend:
+		if r.stream == nil || r.stream.send == nil {
+			return errors.New("No client or bidi stream to send to")
+		}
+		return pace(step.Count, step.Rate, func() error {
+			req, err := newRequest(r.seq, time.Now())
+			if err != nil {
+				return err
+			}
+			return r.stream.sendRequest(req)
+		})
+	case actionExpect:
+		if r.stream == nil {
+			return errors.New("No stream to expect responses from")
+		}
+		if err := r.stream.expectResponses(step.Responses, step.Within); err != nil {
+			return err
+		}
+		if len(step.Code) > 0 {
+			return r.stream.expectEnd(step.code, step.Within)
+		}
+		return nil
+	case actionClose:
+		if r.stream == nil {
+			return errors.New("No stream to close")
+		}
+		return r.closeStream(step)
+	case actionUnary:
+		return pace(step.Count, step.Rate, func() error {
+			return r.unary(step, log)
+		})
+	case actionSleep:
+		select {
+		case <-time.After(step.Duration):
+		case <-shutdown.Done():
+		}
+		return nil
+	}
+	return errors.Errorf("Unknown action %q", step.Action)
+}
+
+// pace call fn count times at rate per second, 0 for as fast as possible, until it fail
+func pace(count int, rate float64, fn func() error) error {
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := 0; i < count; i++ {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-shutdown.Done():
+				return shutdown.Err()
+			}
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *scenarioRunner) unary(step scenarioStep, log *zap.Logger) error {
+	stats := runStats.get(kindUnary)
+	req, err := newRequest(r.seq, time.Now())
+	if err != nil {
+		return err
+	}
+	ctx, cancelFn := withDeadline(shutdown, step.Deadline)
+	defer cancelFn()
+	atomic.AddInt64(&stats.sent, 1)
+	start := time.Now()
+	resp, err := r.client.Unary(withMetadata(r.authContext(ctx), step.Metadata), req, compressorOptions(step.Compressor)...)
+	if err != nil {
+		stats.fail(err)
+	} else {
+		atomic.AddInt64(&stats.ops, 1)
+		atomic.AddInt64(&stats.received, 1)
+		latencies.Record(latencyUnary, time.Since(start))
+		verifyPayload(log, resp)
+	}
+	if code := status.Code(err); code != step.code {
+		return errors.Errorf("Unary call ended with %s, expected %s: %v", code, step.code, err)
+	}
+	return nil
+}
+
+func (r *scenarioRunner) open(kind string, md map[string]string, compressor string, deadline time.Duration, log *zap.Logger) error {
+	stats := runStats.get(kind)
+	ctx, cancelFn := withDeadline(shutdown, deadline)
+	s := &scenarioStream{
+		kind:       kind,
+		metadata:   md,
+		compressor: compressor,
+		deadline:   deadline,
+		cancelFn:   cancelFn,
+		stats:      stats,
+		log:        log.With(zap.String("kind", kind)),
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	ctx = withMetadata(r.authContext(ctx), md)
+	opts := compressorOptions(compressor)
+	var err error
+	switch kind {
+	case kindClient:
+		var stream grpctest.GrpcTest_ClientStreamClient
+		if stream, err = r.client.ClientStream(ctx, opts...); err == nil {
+			s.send = stream.Send
+			s.closeSend = func() error {
+				// the step bound the wait for the summary in expectEnd
+				go func() {
+					// the summary of a client stream isn't part of a sequence
+					_, err := stream.CloseAndRecv()
+					if err == nil {
+						s.counted()
+					}
+					s.end(err)
+				}()
+				return nil
+			}
+		}
+	case kindServer:
+		var (
+			stream grpctest.GrpcTest_ServerStreamClient
+			req    *grpctest.Request
+		)
+		if req, err = newRequest(r.seq, time.Now()); err != nil {
+			cancelFn()
+			return err
+		}
+		if stream, err = r.client.ServerStream(ctx, req, opts...); err == nil {
+			atomic.AddInt64(&stats.sent, 1)
+			s.closeSend = func() error {
+				cancelFn()
+				return nil
+			}
+			go s.receive(stream.Recv)
+		}
+	case kindBidi:
+		var stream grpctest.GrpcTest_BiDirectionalStreamClient
+		if stream, err = r.client.BiDirectionalStream(ctx, opts...); err == nil {
+			s.send = stream.Send
+			s.closeSend = stream.CloseSend
+			go s.receive(stream.Recv)
+		}
+	}
+	if err != nil {
+		cancelFn()
+		stats.fail(err)
+		return errors.Wrapf(err, "Can't open %s stream", kind)
+	}
+	r.stream = s
+	return nil
+}
+
+// closeStream close the current stream, wait for its end and check its status code if step has one
+func (r *scenarioRunner) closeStream(step scenarioStep) error {
+	s := r.stream
+	if s == nil {
+		return nil
+	}
+	r.stream = nil
+	defer s.cancelFn()
+	select {
+	case <-s.done:
+		// already ended, its status was expected by a previous step
+		if len(step.Code) == 0 {
+			return nil
+		}
+	default:
+		if err := s.closeSend(); err != nil {
+			return err
+		}
+	}
+	return s.expectEnd(step.code, step.Within)
+}
+
+// withMetadata add md to the outgoing metadata of ctx
+func withMetadata(ctx context.Context, md map[string]string) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	nice := metautils.ExtractOutgoing(ctx).Clone()
+	for k, v := range md {
+		nice.Set(k, v)
+	}
+	return nice.ToOutgoing(ctx)
+}
+
+// scenarioStream is a stream opened by a scenario, the responses are counted as they come
+type scenarioStream struct {
+	kind       string
+	metadata   map[string]string
+	compressor string
+	deadline   time.Duration
+	cancelFn   context.CancelFunc
+	send       func(*grpctest.Request) error
+	closeSend  func() error
+	stats      *loadStats
+	log        *zap.Logger
+
+	mu    sync.Mutex
+	count int
+	// notify is poked on each response, done is closed when the stream end with err
+	notify chan struct{}
+	done   chan struct{}
+	err    error
+}
+
+func (s *scenarioStream) sendRequest(req *grpctest.Request) error {
+	if err := s.send(req); err != nil {
+		s.stats.fail(err)
+		return errors.Wrap(err, "Can't send request")
+	}
+	atomic.AddInt64(&s.stats.sent, 1)
+	return nil
+}
+
+func (s *scenarioStream) receive(recv func() (*grpctest.Response, error)) {
+	for {
+		resp, err := recv()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			s.end(err)
+			return
+		}
+		s.received(resp)
+	}
+}
+
+func (s *scenarioStream) received(resp *grpctest.Response) {
+	observeResponse(s.log, resp)
+	s.counted()
+}
+
+// counted count a response, and wake up the step waiting for it
+func (s *scenarioStream) counted() {
+	atomic.AddInt64(&s.stats.received, 1)
+	s.mu.Lock()
+	s.count++
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scenarioStream) end(err error) {
+	if err == nil {
+		atomic.AddInt64(&s.stats.ops, 1)
+	} else if status.Code(err) != codes.Canceled {
+		s.stats.fail(err)
+	}
+	s.err = err
+	close(s.done)
+}
+
+func (s *scenarioStream) responses() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// expectResponses wait until the stream received n responses
+func (s *scenarioStream) expectResponses(n int, within time.Duration) error {
+	timeout := time.After(within)
+	for s.responses() < n {
+		select {
+		case <-s.notify:
+		case <-s.done:
+			if s.responses() < n {
+				return errors.Errorf("Stream ended with %d responses, expected %d: %v", s.responses(), n, s.err)
+			}
+		case <-timeout:
+			return errors.Errorf("Got %d responses, expected %d within %s", s.responses(), n, within)
+		}
+	}
+	return nil
+}
+
+// expectEnd wait until the stream end with code
+func (s *scenarioStream) expectEnd(code codes.Code, within time.Duration) error {
+	select {
+	case <-s.done:
+	case <-time.After(within):
+		return errors.Errorf("Stream not ended within %s", within)
+	}
+	if got := status.Code(s.err); got != code && !(got == codes.Canceled && s.kind == kindServer && code == codes.OK) {
+		return errors.Errorf("Stream ended with %s, expected %s: %v", got, code, s.err)
+	}
+	return nil
+}
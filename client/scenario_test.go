@@ -0,0 +1,221 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestScenarioStepInit(t *testing.T) {
+	tests := []struct {
+		name string
+		step scenarioStep
+		// open is the kind of the stream open before the step
+		open    string
+		want    scenarioStep
+		wantErr string
+	}{
+		{
+			name: "open",
+			step: scenarioStep{Action: actionOpen, Kind: kindBidi},
+			want: scenarioStep{Action: actionOpen, Kind: kindBidi, Within: defaultWithin},
+		},
+		{
+			name:    "open unknown kind",
+			step:    scenarioStep{Action: actionOpen, Kind: "unary"},
+			wantErr: "Can't open a stream",
+		},
+		{
+			name: "send default count",
+			step: scenarioStep{Action: actionSend},
+			open: kindClient,
+			want: scenarioStep{Action: actionSend, Count: 1, Within: defaultWithin},
+		},
+		{
+			name:    "send negative rate",
+			step:    scenarioStep{Action: actionSend, Rate: -1},
+			wantErr: "can't be negative",
+		},
+		{
+			name: "send at the highest rate",
+			step: scenarioStep{Action: actionSend, Rate: maxLoadRate},
+			want: scenarioStep{Action: actionSend, Count: 1, Within: defaultWithin},
+		},
+		{
+			name:    "send above the highest rate",
+			step:    scenarioStep{Action: actionSend, Rate: 2e9},
+			wantErr: "Rate can't be above",
+		},
+		{
+			name:    "unary above the highest rate",
+			step:    scenarioStep{Action: actionUnary, Rate: 1e12},
+			wantErr: "Rate can't be above",
+		},
+		{
+			name:    "negative within",
+			step:    scenarioStep{Action: actionExpect, Responses: 1, Within: -time.Second},
+			wantErr: "Within can't be negative",
+		},
+		{
+			name: "unary code",
+			step: scenarioStep{Action: actionUnary, Count: 3, Code: "UNAVAILABLE", Within: time.Second},
+			want: scenarioStep{Action: actionUnary, Count: 3, Code: "UNAVAILABLE", Within: time.Second, code: codes.Unavailable},
+		},
+		{
+			name:    "unary unknown code",
+			step:    scenarioStep{Action: actionUnary, Code: "NOPE"},
+			wantErr: "Unknown status code",
+		},
+		{
+			name:    "sleep without duration",
+			step:    scenarioStep{Action: actionSleep},
+			wantErr: "Missing sleep duration",
+		},
+		{
+			name: "expect on a bidi stream",
+			step: scenarioStep{Action: actionExpect, Responses: 2, Code: "OK"},
+			open: kindBidi,
+			want: scenarioStep{Action: actionExpect, Responses: 2, Code: "OK", Within: defaultWithin, code: codes.OK},
+		},
+		{
+			name:    "expect code on a client stream",
+			step:    scenarioStep{Action: actionExpect, Code: "OK"},
+			open:    kindClient,
+			wantErr: "expect its code on the close step",
+		},
+		{
+			name:    "expect responses on a client stream",
+			step:    scenarioStep{Action: actionExpect, Responses: 1},
+			open:    kindClient,
+			wantErr: "expect its code on the close step",
+		},
+		{
+			name:    "negative deadline",
+			step:    scenarioStep{Action: actionClose, Deadline: -time.Second},
+			wantErr: "Deadline can't be negative",
+		},
+		{
+			name:    "unknown compressor",
+			step:    scenarioStep{Action: actionClose, Compressor: "lz4"},
+			wantErr: "lz4",
+		},
+		{
+			name:    "unknown action",
+			step:    scenarioStep{Action: "jump"},
+			wantErr: "Unknown action",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := tt.step
+			err := step.init(tt.open)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("init() error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("init() error %v", err)
+			}
+			if step.Action != tt.want.Action || step.Kind != tt.want.Kind || step.Count != tt.want.Count ||
+				step.Responses != tt.want.Responses || step.Within != tt.want.Within || step.code != tt.want.code {
+				t.Errorf("init() = %+v, want %+v", step, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScenario(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		steps   int
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			data: `
+name: bidi
+steps:
+  - action: open
+    kind: bidi
+  - action: send
+    count: 10
+  - action: expect
+    responses: 10
+    within: 5s
+  - action: close
+`,
+			steps: 4,
+		},
+		{
+			name:  "json",
+			data:  `{"name": "unary", "steps": [{"action": "unary", "code": "INTERNAL"}]}`,
+			steps: 1,
+		},
+		{
+			name: "client stream expected on close",
+			data: `
+steps:
+  - action: open
+    kind: client
+  - action: send
+  - action: close
+    code: OK
+  - action: open
+    kind: bidi
+  - action: expect
+    code: OK
+`,
+			steps: 5,
+		},
+		{
+			name: "client stream expected before close",
+			data: `
+steps:
+  - action: open
+    kind: client
+  - action: send
+  - action: reconnect
+  - action: expect
+    code: OK
+`,
+			wantErr: "Step 4",
+		},
+		{
+			name:    "without steps",
+			data:    `name: empty`,
+			wantErr: "Scenario without steps",
+		},
+		{
+			name:    "unknown field",
+			data:    `steps: [{action: sleep, duration: 1s, sleep: 2s}]`,
+			wantErr: "Can't parse scenario",
+		},
+		{
+			name:    "invalid step",
+			data:    `steps: [{action: sleep, duration: 1s}, {action: sleep}]`,
+			wantErr: "Step 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseScenario([]byte(tt.data))
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseScenario() error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseScenario() error %v", err)
+			}
+			if len(s.Steps) != tt.steps {
+				t.Errorf("parseScenario() %d steps, want %d", len(s.Steps), tt.steps)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid"
+	"go.uber.org/zap"
+
+	"github.com/bclermont/grpctest/common"
+	"github.com/bclermont/grpctest/proto"
+)
+
+// payloads fill the requests
+var payloads *common.PayloadGenerator
+
+// corrupted count the responses with a wrong checksum
+var corrupted uint64
+
+// sequences track the responses of every server stream, it's reported when the command exit
+var sequences = common.NewSequenceSessions()
+
+// newRequest create a dummy request, numbered by seq
+func newRequest(seq *common.Sequencer, t time.Time) (*grpctest.Request, error) {
+	id, err := ulid.New(ulid.Timestamp(t), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	payload, checksum := payloads.Next()
+	sequence, sentAt := seq.Next()
+	return &grpctest.Request{
+		Value:     id.String(),
+		SessionId: seq.Session,
+		Sequence:  sequence,
+		SentAt:    sentAt,
+		Payload:   payload,
+		Checksum:  checksum,
+	}, nil
+}
+
+// verifyPayload check the checksum of a received response, a mismatch is logged
+func verifyPayload(log *zap.Logger, resp *grpctest.Response) {
+	if !common.VerifyChecksum(resp.Payload, resp.Checksum) {
+		atomic.AddUint64(&corrupted, 1)
+		log.Warn("Payload checksum mismatch", resp.ZapFields()...)
+	}
+}
+
+// observeResponse check the sequence number and the checksum of a received response, anomalies are logged
+func observeResponse(log *zap.Logger, resp *grpctest.Response) {
+	verifyPayload(log, resp)
+	if len(resp.SessionId) == 0 {
+		return
+	}
+	event := sequences.Tracker(resp.SessionId).Observe(resp.Sequence)
+	if event != common.SequenceInOrder {
+		log.Warn("Sequence anomaly", append(resp.ZapFields(), zap.Stringer("event", event))...)
+	}
+}
+
+// printSequenceSummary write the total of the anomalies, and the detail of the streams having some
+func printSequenceSummary(w io.Writer) {
+	sequences.Each(func(session string, stats common.SequenceStats) {
+		if stats.Gaps+stats.Reordered+stats.Duplicates > 0 {
+			fmt.Fprintf(w, "stream %s %s\n", session, formatSequenceStats(stats))
+		}
+	})
+	if streams, total := sequences.Total(); streams > 0 {
+		fmt.Fprintf(w, "%d streams %s\n", streams, formatSequenceStats(total))
+	}
+	if n := atomic.LoadUint64(&corrupted); n > 0 {
+		fmt.Fprintf(w, "%d responses with a payload checksum mismatch\n", n)
+	}
+}
+
+func formatSequenceStats(s common.SequenceStats) string {
+	return fmt.Sprintf("received=%d gaps=%d lost=%d reordered=%d duplicates=%d",
+		s.Received, s.Gaps, s.Lost, s.Reordered, s.Duplicates)
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"crypto/rand"
 	"io"
+	"sync/atomic"
 	"time"
 
-	"github.com/oklog/ulid"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
@@ -24,8 +23,9 @@ func serverCommand() *cobra.Command {
 		interval    time.Duration
 	)
 	return &cobra.Command{
-		Use:   "server",
-		Short: "Run server client",
+		Use:         "server",
+		Short:       "Run server client",
+		Annotations: runAnnotations,
 		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
 			authContext, client, interval, log, err = preUp()
 			return
@@ -36,9 +36,13 @@ func serverCommand() *cobra.Command {
 	}
 }
 
-// ServerClientTest connect to a server and log response when it receive one. stop when it got 10 response
+// ServerClientTest connect to a server and log response when it receive one. stop when it got 10 response, or all echoes in echo mode,
+// or when interrupted
 func ServerClientTest(authContext func(context.Context) context.Context, client grpctest.GrpcTestClient, interval time.Duration, log *zap.Logger) error {
-	const maxReceived = 10
+	maxReceived := 10
+	if echoCount > 0 {
+		maxReceived = echoCount
+	}
 	var (
 		ctx      context.Context
 		cancelFn context.CancelFunc
@@ -46,22 +50,35 @@ func ServerClientTest(authContext func(context.Context) context.Context, client
 		received int
 	)
 	log = log.With(zap.Int("max", maxReceived))
+	seq, err := common.NewSequencer()
+	if err != nil {
+		return err
+	}
+	backoff := common.NewBackoff(backoffPolicy)
+	stats := runStats.get(kindServer)
 
-	for {
+	for shutdown.Err() == nil {
 		log.Debug("Connect to gRPC server")
 		ctx, cancelFn = context.WithCancel(context.Background())
 
-		id, err := ulid.New(ulid.Now(), rand.Reader)
+		req, err := newRequest(seq, time.Now())
 		if err != nil {
 			return err
 		}
-		stream, err := client.ServerStream(authContext(ctx), &grpctest.Request{Value: id.String()})
+		start := time.Now()
+		firstReceived := false
+		stream, err := client.ServerStream(authContext(ctx), req)
 		if err != nil {
 			log.Error("Can't open stream, try again", zap.Error(err))
-			time.Sleep(common.ReconnectInterval)
+			stats.fail(err)
+			countReconnect(kindServer)
+			if err = backoff.Wait(shutdown, log); err != nil {
+				return err
+			}
 			continue
 		}
 		log.Debug("Connected")
+		atomic.AddInt64(&stats.sent, 1)
 
 		go func() {
 			defer cancelFn()
@@ -81,6 +98,7 @@ func ServerClientTest(authContext func(context.Context) context.Context, client
 						return
 					}
 					log.Error("Error receive stream", zap.Error(err))
+					stats.fail(err)
 					return
 				}
 			}
@@ -92,18 +110,38 @@ func ServerClientTest(authContext func(context.Context) context.Context, client
 			case <-ctx.Done():
 				log.Info("Context done, stop receive from stream", zap.Error(ctx.Err()))
 				break selectLoop
+			case <-shutdown.Done():
+				// the client can't end a server stream, cancel it
+				log.Info("Interrupted, cancel stream")
+				cancelFn()
+				return nil
 			case resp := <-respChan:
 				// process response
+				if !firstReceived {
+					firstReceived = true
+					latencies.Record(latencyFirstMessage, time.Since(start))
+				}
 				received++
+				backoff.Reset()
+				atomic.AddInt64(&stats.received, 1)
 				sLog := log.With(zap.Int("received", received))
 				sLog.Debug("Received response", resp.ZapFields()...)
+				observeResponse(sLog, resp)
+				if echoCount > 0 {
+					verifyEcho(sLog, req.Value, resp)
+				}
 				if received >= maxReceived {
+					atomic.AddInt64(&stats.ops, 1)
 					return stream.CloseSend()
 				}
 			}
 		}
 
 		log.Debug("Disconnected from server, reconnect")
-		time.Sleep(common.ReconnectInterval)
+		countReconnect(kindServer)
+		if err = backoff.Wait(shutdown, log); err != nil {
+			return err
+		}
 	}
+	return nil
 }
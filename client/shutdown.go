@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	exitError = 1
+	// exitAnomalies is the exit code when the summary report lost, duplicated, reordered or corrupted messages
+	exitAnomalies = 2
+	// exitForced is the exit code when a second signal interrupt the shutdown
+	exitForced = 130
+	// closeTimeout bound the wait for the server to end a stream after the client closed it
+	closeTimeout = time.Second * 5
+)
+
+// shutdown is cancelled by the first SIGINT or SIGTERM, the client commands then close their streams and return
+var shutdown = context.Background()
+
+// handleSignals cancel shutdown on the first signal, and exit on the second one
+func handleSignals() {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	shutdown = ctx
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "Received %s, shutting down, send it again to force\n", sig)
+		cancelFn()
+		<-signals
+		os.Exit(exitForced)
+	}()
+}
+
+// anomalies tell if the summary reported lost, duplicated, reordered or corrupted messages
+func anomalies() bool {
+	_, total := sequences.Total()
+	return total.Lost+total.Reordered+total.Duplicates > 0 ||
+		atomic.LoadUint64(&corrupted) > 0 ||
+		atomic.LoadUint64(&echoMismatches) > 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+
+	"github.com/bclermont/grpctest/common"
+	"github.com/bclermont/grpctest/proto"
+)
+
+func unaryCommand() *cobra.Command {
+	var (
+		authContext func(context.Context) context.Context
+		client      grpctest.GrpcTestClient
+		log         *zap.Logger
+		interval    time.Duration
+	)
+	return &cobra.Command{
+		Use:         "unary",
+		Short:       "Run unary client",
+		Annotations: runAnnotations,
+		PreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			authContext, client, interval, log, err = preUp()
+			return
+		},
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return UnaryClientTest(authContext, client, interval, log)
+		},
+	}
+}
+
+// UnaryClientTest periodically send a request to a server and log the response with its latency. try until interrupted or the reconnect policy give up
+func UnaryClientTest(authContext func(context.Context) context.Context, client grpctest.GrpcTestClient, interval time.Duration, log *zap.Logger) error {
+	seq, err := common.NewSequencer()
+	if err != nil {
+		return err
+	}
+	backoff := common.NewBackoff(backoffPolicy)
+	stats := runStats.get(kindUnary)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var t time.Time
+		select {
+		case <-shutdown.Done():
+			log.Info("Interrupted, stop")
+			return nil
+		case t = <-ticker.C:
+		}
+		// send some dummy request
+		req, err := newRequest(seq, t)
+		if err != nil {
+			log.Error("Can't generate ULID", zap.Error(err))
+			if err = backoff.Wait(shutdown, log); err != nil {
+				return err
+			}
+			continue
+		}
+
+		start := time.Now()
+		atomic.AddInt64(&stats.sent, 1)
+		resp, err := client.Unary(authContext(context.Background()), req)
+		latency := time.Since(start)
+		if err != nil {
+			stats.fail(err)
+			log.Error("Can't send request, try again", append(common.GrpcErrorFields(err), zap.Duration("latency", latency))...)
+			if err = backoff.Wait(shutdown, log); err != nil {
+				return err
+			}
+			continue
+		}
+		backoff.Reset()
+		atomic.AddInt64(&stats.ops, 1)
+		atomic.AddInt64(&stats.received, 1)
+		latencies.Record(latencyUnary, latency)
+		log.Debug("Sent request", req.ZapFields()...)
+		log.Debug("Received response", append(resp.ZapFields(), zap.Duration("latency", latency))...)
+		verifyPayload(log, resp)
+		if echoCount > 0 {
+			verifyEcho(log, req.Value, resp)
+		}
+		if resp.Sequence != req.Sequence {
+			log.Warn("Response doesn't match request", zap.Uint64("request", req.Sequence), zap.Uint64("response", resp.Sequence))
+		}
+	}
+}
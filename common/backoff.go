@@ -0,0 +1,152 @@
+package common
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+const (
+	// BackoffNone wait exactly the exponential delay
+	BackoffNone = "none"
+	// BackoffFull wait a random delay between 0 and the exponential delay
+	BackoffFull = "full"
+	// BackoffDecorrelated wait a random delay between the initial delay and 3 times the previous one
+	BackoffDecorrelated = "decorrelated"
+
+	keyReconnectInitial     = "reconnect_initial"
+	keyReconnectMax         = "reconnect_max"
+	keyReconnectMultiplier  = "reconnect_multiplier"
+	keyReconnectJitter      = "reconnect_jitter"
+	keyReconnectMaxAttempts = "reconnect_max_attempts"
+)
+
+func init() {
+	viper.SetDefault(keyReconnectInitial, ReconnectInterval)
+	viper.SetDefault(keyReconnectMax, time.Minute)
+	viper.SetDefault(keyReconnectMultiplier, 2.0)
+	viper.SetDefault(keyReconnectJitter, BackoffFull)
+}
+
+// BackoffFlags add the reconnect policy options to flags, they override the environment variables
+func BackoffFlags(flags *pflag.FlagSet) {
+	flags.Duration(flagName(keyReconnectInitial), ReconnectInterval, "delay before the first reconnect")
+	flags.Duration(flagName(keyReconnectMax), time.Minute, "maximum delay between reconnects")
+	flags.Float64(flagName(keyReconnectMultiplier), 2, "growth of the delay after each failed attempt")
+	flags.String(flagName(keyReconnectJitter), BackoffFull, "randomize the delay: none, full or decorrelated")
+	flags.Int(flagName(keyReconnectMaxAttempts), 0, "give up after this many consecutive failed attempts, 0 to retry forever")
+	for _, key := range []string{keyReconnectInitial, keyReconnectMax, keyReconnectMultiplier, keyReconnectJitter, keyReconnectMaxAttempts} {
+		viper.BindPFlag(key, flags.Lookup(flagName(key)))
+	}
+}
+
+// BackoffPolicy configure the delay between reconnect attempts
+type BackoffPolicy struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      string
+	MaxAttempts int
+}
+
+// LoadBackoffPolicy read the reconnect policy from the configuration
+func LoadBackoffPolicy() (BackoffPolicy, error) {
+	p := BackoffPolicy{
+		Initial:     viper.GetDuration(keyReconnectInitial),
+		Max:         viper.GetDuration(keyReconnectMax),
+		Multiplier:  viper.GetFloat64(keyReconnectMultiplier),
+		Jitter:      viper.GetString(keyReconnectJitter),
+		MaxAttempts: viper.GetInt(keyReconnectMaxAttempts),
+	}
+	if p.Initial <= 0 {
+		return p, errors.Errorf("Invalid %q %s", keyReconnectInitial, p.Initial)
+	}
+	if p.Max < p.Initial {
+		return p, errors.Errorf("%q %s is lower than %q %s", keyReconnectMax, p.Max, keyReconnectInitial, p.Initial)
+	}
+	if p.Multiplier < 1 {
+		return p, errors.Errorf("Invalid %q %g", keyReconnectMultiplier, p.Multiplier)
+	}
+	switch p.Jitter {
+	case BackoffNone, BackoffFull, BackoffDecorrelated:
+	default:
+		return p, errors.Errorf("Unknown %q %q", keyReconnectJitter, p.Jitter)
+	}
+	return p, nil
+}
+
+// Backoff compute the delays of a sequence of reconnect attempts, it isn't safe for concurrent use
+type Backoff struct {
+	policy  BackoffPolicy
+	attempt int
+	last    time.Duration
+	rand    *rand.Rand
+}
+
+// NewBackoff start a sequence of attempts following policy
+func NewBackoff(policy BackoffPolicy) *Backoff {
+	return &Backoff{policy: policy, rand: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+// Next return the delay before the next attempt and its number, starting at 1.
+// ok is false once the maximum number of attempts is reached.
+func (b *Backoff) Next() (delay time.Duration, attempt int, ok bool) {
+	if b.policy.MaxAttempts > 0 && b.attempt >= b.policy.MaxAttempts {
+		return 0, b.attempt, false
+	}
+	b.attempt++
+	p := b.policy
+	switch p.Jitter {
+	case BackoffDecorrelated:
+		upper := p.Initial
+		if b.last > 0 {
+			upper = b.last * 3
+		}
+		if upper > p.Max {
+			upper = p.Max
+		}
+		delay = p.Initial
+		if upper > p.Initial {
+			delay += time.Duration(b.rand.Int63n(int64(upper - p.Initial)))
+		}
+	default:
+		exp := float64(p.Initial) * math.Pow(p.Multiplier, float64(b.attempt-1))
+		delay = p.Max
+		if exp < float64(p.Max) {
+			delay = time.Duration(exp)
+		}
+		if p.Jitter == BackoffFull {
+			delay = time.Duration(b.rand.Int63n(int64(delay) + 1))
+		}
+	}
+	b.last = delay
+	return delay, b.attempt, true
+}
+
+// Reset start over after a successful attempt
+func (b *Backoff) Reset() {
+	b.attempt = 0
+	b.last = 0
+}
+
+// Wait sleep before the next attempt or until ctx is done, it return an error once the maximum number of attempts is reached
+func (b *Backoff) Wait(ctx context.Context, log *zap.Logger) error {
+	delay, attempt, ok := b.Next()
+	if !ok {
+		return errors.Errorf("Give up after %d attempts", attempt)
+	}
+	log.Info("Wait before next attempt", zap.Int("attempt", attempt), zap.Duration("delay", delay))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil
+}
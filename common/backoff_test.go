@@ -0,0 +1,89 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy BackoffPolicy
+		// min and max bound the delay of each attempt
+		min, max []time.Duration
+	}{
+		{
+			name:   "exponential",
+			policy: BackoffPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Jitter: BackoffNone},
+			min:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+			max:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:   "full jitter",
+			policy: BackoffPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Jitter: BackoffFull},
+			min:    []time.Duration{0, 0, 0, 0, 0, 0},
+			max:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:   "decorrelated jitter",
+			policy: BackoffPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2, Jitter: BackoffDecorrelated},
+			min:    []time.Duration{time.Second, time.Second, time.Second, time.Second, time.Second, time.Second},
+			max:    []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 10 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the random delays are checked over several sequences
+			for run := 0; run < 100; run++ {
+				b := NewBackoff(tt.policy)
+				var last time.Duration
+				for i := range tt.min {
+					delay, attempt, ok := b.Next()
+					if !ok || attempt != i+1 {
+						t.Fatalf("Next() attempt %d, ok %v, want %d, true", attempt, ok, i+1)
+					}
+					if delay < tt.min[i] || delay > tt.max[i] {
+						t.Fatalf("Next() attempt %d delay %s, want between %s and %s", attempt, delay, tt.min[i], tt.max[i])
+					}
+					if tt.policy.Jitter == BackoffDecorrelated && last > 0 && delay > 3*last {
+						t.Fatalf("Next() attempt %d delay %s, more than 3 times the previous %s", attempt, delay, last)
+					}
+					last = delay
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffMaxAttempts(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		attempts    int
+	}{
+		{name: "unlimited", maxAttempts: 0, attempts: 50},
+		{name: "one", maxAttempts: 1, attempts: 1},
+		{name: "three", maxAttempts: 3, attempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := BackoffPolicy{Initial: time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: BackoffNone, MaxAttempts: tt.maxAttempts}
+			b := NewBackoff(policy)
+			for i := 0; i < tt.attempts; i++ {
+				if _, _, ok := b.Next(); !ok {
+					t.Fatalf("Next() gave up at attempt %d, want %d attempts", i+1, tt.attempts)
+				}
+			}
+			if tt.maxAttempts == 0 {
+				return
+			}
+			if _, attempt, ok := b.Next(); ok || attempt != tt.maxAttempts {
+				t.Errorf("Next() after the last attempt = %d, %v, want %d, false", attempt, ok, tt.maxAttempts)
+			}
+			b.Reset()
+			if delay, attempt, ok := b.Next(); !ok || attempt != 1 || delay != policy.Initial {
+				t.Errorf("Next() after Reset = %s, %d, %v, want %s, 1, true", delay, attempt, ok, policy.Initial)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the files written by GenerateCertificates
+const (
+	CAFile        = "ca.pem"
+	ServerCert    = "server.pem"
+	ServerKey     = "server-key.pem"
+	ClientCert    = "client.pem"
+	ClientKey     = "client-key.pem"
+	certSerialLen = 128
+)
+
+// GenerateCertificates write to dir a self-signed CA, a server certificate valid for hosts and a client certificate,
+// all signed by the CA
+func GenerateCertificates(dir string, hosts []string, validity time.Duration) error {
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(validity)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate, err := certTemplate("grpctest CA", notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return errors.Wrap(err, "Can't create CA certificate")
+	}
+	if err = writePEM(filepath.Join(dir, CAFile), "CERTIFICATE", caDER); err != nil {
+		return err
+	}
+
+	serverTemplate, err := certTemplate(hosts[0], notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+	if err = writeSignedPair(dir, ServerCert, ServerKey, serverTemplate, caTemplate, caKey); err != nil {
+		return err
+	}
+
+	clientTemplate, err := certTemplate("grpctest client", notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return writeSignedPair(dir, ClientCert, ClientKey, clientTemplate, caTemplate, caKey)
+}
+
+func certTemplate(commonName string, notBefore, notAfter time.Time) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), certSerialLen))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+func writeSignedPair(dir, certFile, keyFile string, template, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return errors.Wrapf(err, "Can't create certificate %q", certFile)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = writePEM(filepath.Join(dir, certFile), "CERTIFICATE", der); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, keyFile), "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return errors.Wrapf(ioutil.WriteFile(path, data, 0600), "Can't write %q", path)
+}
@@ -2,6 +2,8 @@ package common
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -19,25 +21,28 @@ const (
 	keyPort          = "port"
 	keyKey           = "key"
 	keyInterval      = "interval"
+	keyKeysFile      = "keys_file"
+	keyKeysGrace     = "keys_grace"
 	errMissingFormat = "Missing %q"
 )
 
 func init() {
 	viper.SetDefault(keyInterval, time.Second*15)
 	viper.SetDefault(keyPort, 8841)
+	viper.SetDefault(keyKeysGrace, time.Minute)
 }
 
 func Init() (port int, apiKey string, interval time.Duration, log *zap.Logger) {
 	viper.AutomaticEnv()
 	port = viper.GetInt(keyPort)
-	apiKey = viper.GetString(keyKey)
+	apiKey = APIKey()
 	interval = viper.GetDuration(keyInterval)
 
 	log, err := zap.NewDevelopment()
 	if err != nil {
 		panic(err)
 	}
-	if len(apiKey) == 0 {
+	if len(apiKey) == 0 && len(KeysFile()) == 0 && AuthMode() != AuthModeJWT {
 		log.Fatal(fmt.Sprintf(errMissingFormat, keyKey))
 	}
 	if port == 0 {
@@ -46,6 +51,21 @@ func Init() (port int, apiKey string, interval time.Duration, log *zap.Logger) {
 	return
 }
 
+// APIKey return the single API key
+func APIKey() string {
+	return viper.GetString(keyKey)
+}
+
+// KeysFile return the path of the server API keys file, empty if the single KEY is used
+func KeysFile() string {
+	return viper.GetString(keyKeysFile)
+}
+
+// KeysGrace return how long the previous API keys stay valid after a reload
+func KeysGrace() time.Duration {
+	return viper.GetDuration(keyKeysGrace)
+}
+
 func GrpcErrorFields(err error) []zapcore.Field {
 	code := grpc.Code(err)
 	return []zapcore.Field{
@@ -57,3 +77,20 @@ func GrpcErrorFields(err error) []zapcore.Field {
 func GrpcCodeField(code codes.Code) zapcore.Field {
 	return zap.String("code", code.String())
 }
+
+// ParseCode parse a gRPC status code from its name, as in "Unavailable" or "UNAVAILABLE", or its number
+func ParseCode(s string) (codes.Code, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		if n > uint64(codes.Unauthenticated) {
+			return codes.Unknown, fmt.Errorf("Unknown status code %d", n)
+		}
+		return codes.Code(n), nil
+	}
+	name := strings.Replace(strings.ToLower(s), "_", "", -1)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == name {
+			return c, nil
+		}
+	}
+	return codes.Unknown, fmt.Errorf("Unknown status code %q", s)
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"compress/flate"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// CompressorIdentity is the name of the absence of compression
+const CompressorIdentity = "identity"
+
+var (
+	compressorsMu sync.Mutex
+	// compressorNames are the registered compressors, gzip is registered by gRPC
+	compressorNames = []string{gzip.Name}
+)
+
+func init() {
+	RegisterCompressor(&streamCompressor{
+		name: "deflate",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flate.DefaultCompression)
+		},
+		newReader: func(r io.Reader) (io.Reader, error) {
+			return flate.NewReader(r), nil
+		},
+	})
+	RegisterCompressor(&streamCompressor{
+		name: "snappy",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.Reader, error) {
+			return snappy.NewReader(r), nil
+		},
+	})
+}
+
+// RegisterCompressor make a compressor available to the client and the server, for other algorithms like zstd
+func RegisterCompressor(c encoding.Compressor) {
+	encoding.RegisterCompressor(c)
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressorNames = append(compressorNames, c.Name())
+}
+
+// Compressors return the names of the registered compressors, sorted
+func Compressors() []string {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	names := append([]string(nil), compressorNames...)
+	sort.Strings(names)
+	return names
+}
+
+// CheckCompressor return an error if name isn't a registered compressor, empty or identity
+func CheckCompressor(name string) error {
+	if len(name) == 0 || name == CompressorIdentity || encoding.GetCompressor(name) != nil {
+		return nil
+	}
+	return errors.Errorf("Unknown compressor %q, expected one of %s", name, strings.Join(Compressors(), ", "))
+}
+
+// streamCompressor adapt a streaming compression format to gRPC
+type streamCompressor struct {
+	name      string
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	newReader func(io.Reader) (io.Reader, error)
+}
+
+func (c *streamCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return c.newWriter(w)
+}
+
+func (c *streamCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return c.newReader(r)
+}
+
+func (c *streamCompressor) Name() string {
+	return c.name
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"crypto/sha256"
+	"hash"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataEcho ask the server to echo requests. The value is the number of echoes of a server stream,
+// any positive value enable echo for the other methods.
+const MetadataEcho = "x-grpctest-echo"
+
+// EchoCount return the number of echoes requested in the call metadata, 0 if echo isn't requested
+func EchoCount(ctx context.Context) int {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[MetadataEcho]) == 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(md[MetadataEcho][0])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Digest summarize a sequence of requests, to compare what a client sent with what the server received
+type Digest struct {
+	Count uint64
+	Bytes uint64
+	hash  hash.Hash
+}
+
+// NewDigest create an empty digest
+func NewDigest() *Digest {
+	return &Digest{hash: sha256.New()}
+}
+
+// Add a request value and payload
+func (d *Digest) Add(value string, payload []byte) {
+	d.Count++
+	d.Bytes += uint64(len(payload))
+	d.hash.Write([]byte(value))
+	d.hash.Write([]byte{'\n'})
+}
+
+// Sum return the SHA-256 of the values
+func (d *Digest) Sum() []byte {
+	return d.hash.Sum(nil)
+}
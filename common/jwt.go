@@ -0,0 +1,60 @@
+package common
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Authentication modes
+const (
+	AuthModeKey = "key"
+	AuthModeJWT = "jwt"
+)
+
+const (
+	keyAuthMode      = "auth_mode"
+	keyJWTSecret     = "jwt_secret"
+	keyJWTJWKS       = "jwt_jwks"
+	keyJWTSigningKey = "jwt_signing_key"
+	keyJWTKeyID      = "jwt_key_id"
+	keyJWTAudience   = "jwt_audience"
+	keyJWTSubject    = "jwt_subject"
+	keyJWTTTL        = "jwt_ttl"
+)
+
+func init() {
+	viper.SetDefault(keyAuthMode, AuthModeKey)
+	viper.SetDefault(keyJWTSubject, "grpctest")
+	viper.SetDefault(keyJWTTTL, time.Minute*5)
+}
+
+// JWTConfig is the configuration of the JWT authentication mode.
+// The server use Secret and JWKSFile to validate tokens, the client use Secret or SigningKeyFile to mint them.
+type JWTConfig struct {
+	Secret         string
+	JWKSFile       string
+	SigningKeyFile string
+	KeyID          string
+	Audience       string
+	Subject        string
+	TTL            time.Duration
+}
+
+// AuthMode return how calls are authenticated, AuthModeKey or AuthModeJWT
+func AuthMode() string {
+	return viper.GetString(keyAuthMode)
+}
+
+// LoadJWTConfig read the JWT configuration
+func LoadJWTConfig() JWTConfig {
+	return JWTConfig{
+		Secret:         viper.GetString(keyJWTSecret),
+		JWKSFile:       viper.GetString(keyJWTJWKS),
+		SigningKeyFile: viper.GetString(keyJWTSigningKey),
+		KeyID:          viper.GetString(keyJWTKeyID),
+		Audience:       viper.GetString(keyJWTAudience),
+		Subject:        viper.GetString(keyJWTSubject),
+		TTL:            viper.GetDuration(keyJWTTTL),
+	}
+}
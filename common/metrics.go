@@ -0,0 +1,108 @@
+package common
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const keyMetrics = "metrics"
+
+var (
+	activeServerStreams = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_server_active_streams",
+			Help: "Number of streams currently open on the server.",
+		}, []string{"grpc_method"})
+	activeClientStreams = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_client_active_streams",
+			Help: "Number of streams currently open by the client.",
+		}, []string{"grpc_method"})
+)
+
+func init() {
+	prometheus.MustRegister(activeServerStreams, activeClientStreams)
+}
+
+// StartMetrics serve prometheus metrics on /metrics if an address is configured
+func StartMetrics(log *zap.Logger) {
+	addr := viper.GetString(keyMetrics)
+	if len(addr) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Info("Listen metrics", zap.String("address", addr))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("Can't serve metrics", zap.Error(err), zap.String("address", addr))
+		}
+	}()
+}
+
+// ActiveStreamServerInterceptor track the number of open streams per method on the server
+func ActiveStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		gauge := activeServerStreams.WithLabelValues(info.FullMethod)
+		gauge.Inc()
+		defer gauge.Dec()
+		return handler(srv, ss)
+	}
+}
+
+// ActiveStreamClientInterceptor track the number of open streams per method on the client
+func ActiveStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		s := &activeClientStream{
+			ClientStream: stream,
+			desc:         desc,
+			gauge:        activeClientStreams.WithLabelValues(method),
+			done:         make(chan struct{}),
+		}
+		s.gauge.Inc()
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.finish()
+			case <-s.done:
+			}
+		}()
+		return s, nil
+	}
+}
+
+// activeClientStream decrement its gauge once, when the stream end or its context is done
+type activeClientStream struct {
+	grpc.ClientStream
+	desc  *grpc.StreamDesc
+	gauge prometheus.Gauge
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (s *activeClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	// the single response of a client stream end it
+	if err != nil || !s.desc.ServerStreams {
+		s.finish()
+	}
+	return err
+}
+
+func (s *activeClientStream) finish() {
+	s.once.Do(func() {
+		s.gauge.Dec()
+		close(s.done)
+	})
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Payload patterns
+const (
+	PayloadZeros  = "zeros"
+	PayloadRandom = "random"
+	PayloadText   = "text"
+)
+
+const (
+	keyPayloadSize     = "payload_size"
+	keyPayloadPattern  = "payload_pattern"
+	keyPayloadChecksum = "payload_checksum"
+	keyMaxMessageSize  = "max_message_size"
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// payloadWords make a compressible text
+	payloadWords = strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor " +
+		"incididunt ut labore et dolore magna aliqua ut enim ad minim veniam quis nostrud exercitation ullamco")
+)
+
+func init() {
+	viper.SetDefault(keyPayloadSize, "0")
+	viper.SetDefault(keyPayloadPattern, PayloadRandom)
+}
+
+// PayloadFlags add the payload options to flags, they override the environment variables
+func PayloadFlags(flags *pflag.FlagSet) {
+	flags.String(flagName(keyPayloadSize), "0", `payload size: fixed as "1MiB", "uniform:MIN-MAX", "normal:MEAN,STDDEV" or "exponential:MEAN"`)
+	flags.String(flagName(keyPayloadPattern), PayloadRandom, "payload content: zeros, random or text")
+	flags.Bool(flagName(keyPayloadChecksum), false, "send payload checksums to be verified by the receiver")
+	flags.String(flagName(keyMaxMessageSize), "", "maximum size of a message sent or received, empty for 4MiB")
+	for _, key := range []string{keyPayloadSize, keyPayloadPattern, keyPayloadChecksum, keyMaxMessageSize} {
+		viper.BindPFlag(key, flags.Lookup(flagName(key)))
+	}
+}
+
+// flagName turn a configuration key into a command line flag name
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// defaultMaxMessageSize is the gRPC limit of the messages received
+const defaultMaxMessageSize = 4 << 20
+
+// MaxMessageSize return the maximum size of a message sent or received, 0 for the gRPC default of 4 MiB
+func MaxMessageSize() (int, error) {
+	size, err := ParseSize(viper.GetString(keyMaxMessageSize))
+	return int(size), err
+}
+
+// ParseSize parse a number of bytes with an optional KiB, MiB or GiB suffix, an empty string is 0
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, multiplier = strings.TrimSuffix(s, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, errors.Errorf("Invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// sizeDistribution pick payload sizes
+type sizeDistribution func(r *rand.Rand) int64
+
+// parseSizeDistribution parse a payload size, it can be a fixed size as "1MiB", "uniform:MIN-MAX",
+// "normal:MEAN,STDDEV" or "exponential:MEAN". The sizes can't be above max, the random ones are capped.
+func parseSizeDistribution(spec string, max int64) (sizeDistribution, error) {
+	kind, args := "fixed", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, args = spec[:i], spec[i+1:]
+	}
+	parseArgs := func(sep string, count int) ([]int64, error) {
+		parts := strings.Split(args, sep)
+		if len(parts) != count {
+			return nil, errors.Errorf("Invalid payload size %q", spec)
+		}
+		values := make([]int64, count)
+		for i, part := range parts {
+			v, err := ParseSize(part)
+			if err != nil {
+				return nil, err
+			}
+			if v > max {
+				// every call would fail with RESOURCE_EXHAUSTED
+				return nil, errors.Errorf("Invalid payload size %q, above the maximum message size of %d bytes", spec, max)
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+
+	switch kind {
+	case "fixed":
+		v, err := parseArgs(",", 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(*rand.Rand) int64 { return v[0] }, nil
+	case "uniform":
+		v, err := parseArgs("-", 2)
+		if err != nil {
+			return nil, err
+		}
+		if v[1] < v[0] {
+			return nil, errors.Errorf("Invalid payload size %q, max is lower than min", spec)
+		}
+		return func(r *rand.Rand) int64 { return v[0] + r.Int63n(v[1]-v[0]+1) }, nil
+	case "normal":
+		v, err := parseArgs(",", 2)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *rand.Rand) int64 {
+			return int64(math.Min(float64(max), math.Max(0, r.NormFloat64()*float64(v[1])+float64(v[0]))))
+		}, nil
+	case "exponential":
+		v, err := parseArgs(",", 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *rand.Rand) int64 { return int64(math.Min(float64(max), r.ExpFloat64()*float64(v[0]))) }, nil
+	}
+	return nil, errors.Errorf("Unknown payload size distribution %q", kind)
+}
+
+// PayloadGenerator create the filler data of messages
+type PayloadGenerator struct {
+	size     sizeDistribution
+	pattern  string
+	checksum bool
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewPayloadGenerator create payloads of sizeSpec bytes filled with pattern, at most maxSize bytes,
+// see parseSizeDistribution for sizeSpec
+func NewPayloadGenerator(sizeSpec, pattern string, checksum bool, maxSize int64) (*PayloadGenerator, error) {
+	size, err := parseSizeDistribution(sizeSpec, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	switch pattern {
+	case PayloadZeros, PayloadRandom, PayloadText:
+	default:
+		return nil, errors.Errorf("Unknown payload pattern %q", pattern)
+	}
+	return &PayloadGenerator{
+		size:     size,
+		pattern:  pattern,
+		checksum: checksum,
+		rand:     rand.New(rand.NewSource(rand.Int63())),
+	}, nil
+}
+
+// LoadPayloadGenerator create the payload generator from the configuration
+func LoadPayloadGenerator() (*PayloadGenerator, error) {
+	maxSize, err := MaxMessageSize()
+	if err != nil {
+		return nil, err
+	}
+	if maxSize == 0 {
+		maxSize = defaultMaxMessageSize
+	}
+	return NewPayloadGenerator(
+		viper.GetString(keyPayloadSize),
+		viper.GetString(keyPayloadPattern),
+		viper.GetBool(keyPayloadChecksum),
+		int64(maxSize),
+	)
+}
+
+// Next return a new payload and its checksum, the checksum is empty if it's disabled
+func (g *PayloadGenerator) Next() (payload, checksum []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := g.size(g.rand)
+	if n == 0 {
+		return nil, nil
+	}
+	payload = make([]byte, n)
+	switch g.pattern {
+	case PayloadRandom:
+		g.rand.Read(payload)
+	case PayloadText:
+		var buf bytes.Buffer
+		buf.Grow(int(n))
+		for int64(buf.Len()) < n {
+			buf.WriteString(payloadWords[g.rand.Intn(len(payloadWords))])
+			buf.WriteByte(' ')
+		}
+		copy(payload, buf.Bytes())
+	}
+	if g.checksum {
+		checksum = Checksum(payload)
+	}
+	return payload, checksum
+}
+
+// Checksum return the big-endian CRC-32C of payload
+func Checksum(payload []byte) []byte {
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum(payload, crcTable))
+	return checksum
+}
+
+// VerifyChecksum return false if a checksum is set and doesn't match the payload
+func VerifyChecksum(payload, checksum []byte) bool {
+	return len(checksum) == 0 || bytes.Equal(checksum, Checksum(payload))
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "1024", want: 1024},
+		{in: " 12 ", want: 12},
+		{in: "1KiB", want: 1 << 10},
+		{in: "64 KiB", want: 64 << 10},
+		{in: "1MiB", want: 1 << 20},
+		{in: "2GiB", want: 2 << 30},
+		{in: "-1", wantErr: true},
+		{in: "1.5MiB", wantErr: true},
+		{in: "1MB", wantErr: true},
+		{in: "MiB", wantErr: true},
+		{in: "9999999999GiB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize(%q) error %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSizeDistribution(t *testing.T) {
+	const maxSize = 4 << 20
+	tests := []struct {
+		spec string
+		// min and max bound the sizes picked
+		min, max int64
+		wantErr  bool
+	}{
+		{spec: "0", min: 0, max: 0},
+		{spec: "1KiB", min: 1 << 10, max: 1 << 10},
+		{spec: "4MiB", min: maxSize, max: maxSize},
+		{spec: "uniform:1KiB-8KiB", min: 1 << 10, max: 8 << 10},
+		{spec: "uniform:0-4MiB", min: 0, max: maxSize},
+		{spec: "normal:3MiB,1MiB", min: 0, max: maxSize},
+		{spec: "exponential:1MiB", min: 0, max: maxSize},
+		{spec: "5MiB", wantErr: true},
+		{spec: "uniform:0-9223372036854775807", wantErr: true},
+		{spec: "uniform:8KiB-1KiB", wantErr: true},
+		{spec: "normal:8MiB,1KiB", wantErr: true},
+		{spec: "exponential:5MiB", wantErr: true},
+		{spec: "uniform:1KiB", wantErr: true},
+		{spec: "pareto:1KiB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			size, err := parseSizeDistribution(tt.spec, maxSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSizeDistribution(%q) error %v, want error %v", tt.spec, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 1000; i++ {
+				if n := size(r); n < tt.min || n > tt.max {
+					t.Fatalf("parseSizeDistribution(%q) picked %d, want between %d and %d", tt.spec, n, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
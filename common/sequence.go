@@ -0,0 +1,213 @@
+package common
+
+import (
+	"container/list"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// maxMissing bound the number of missing sequence numbers remembered to detect late messages
+	maxMissing = 100000
+	// maxSessions bound the number of sessions tracked, a forgotten session seen again start over
+	maxSessions = 10000
+)
+
+// Sequencer number the messages sent in a session
+type Sequencer struct {
+	Session string
+	last    uint64
+}
+
+// NewSequencer start a new session with a random ID
+func NewSequencer() (*Sequencer, error) {
+	id, err := ulid.New(ulid.Now(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Sequencer{Session: id.String()}, nil
+}
+
+// Next return the sequence number and send time of the next message
+func (s *Sequencer) Next() (sequence uint64, sentAt int64) {
+	return atomic.AddUint64(&s.last, 1), time.Now().UnixNano()
+}
+
+// SequenceEvent is the outcome of receiving a message
+type SequenceEvent int
+
+// Sequence events
+const (
+	// SequenceInOrder is the expected next message
+	SequenceInOrder SequenceEvent = iota
+	// SequenceGap is a message after some missing ones, they are counted as lost until they arrive
+	SequenceGap
+	// SequenceReordered is a missing message arriving late
+	SequenceReordered
+	// SequenceDuplicate is a message already received
+	SequenceDuplicate
+)
+
+func (e SequenceEvent) String() string {
+	switch e {
+	case SequenceInOrder:
+		return "in order"
+	case SequenceGap:
+		return "gap"
+	case SequenceReordered:
+		return "reordered"
+	case SequenceDuplicate:
+		return "duplicate"
+	}
+	return fmt.Sprintf("SequenceEvent(%d)", int(e))
+}
+
+// SequenceStats count the anomalies of a session
+type SequenceStats struct {
+	Received   uint64
+	Gaps       uint64
+	Lost       uint64
+	Reordered  uint64
+	Duplicates uint64
+}
+
+// ZapFields of the stats
+func (s SequenceStats) ZapFields() []zapcore.Field {
+	return []zapcore.Field{
+		zap.Uint64("received", s.Received),
+		zap.Uint64("gaps", s.Gaps),
+		zap.Uint64("lost", s.Lost),
+		zap.Uint64("reordered", s.Reordered),
+		zap.Uint64("duplicates", s.Duplicates),
+	}
+}
+
+// Add the stats of another session
+func (s *SequenceStats) Add(other SequenceStats) {
+	s.Received += other.Received
+	s.Gaps += other.Gaps
+	s.Lost += other.Lost
+	s.Reordered += other.Reordered
+	s.Duplicates += other.Duplicates
+}
+
+// SequenceTracker detect lost, duplicated and reordered messages of a session from their sequence numbers
+type SequenceTracker struct {
+	mu      sync.Mutex
+	next    uint64
+	missing map[uint64]struct{}
+	stats   SequenceStats
+}
+
+// NewSequenceTracker expect the first message of the session to have the sequence number 1
+func NewSequenceTracker() *SequenceTracker {
+	return &SequenceTracker{next: 1, missing: make(map[uint64]struct{})}
+}
+
+// Observe a received sequence number
+func (t *SequenceTracker) Observe(sequence uint64) SequenceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Received++
+	switch {
+	case sequence == t.next:
+		t.next++
+		return SequenceInOrder
+	case sequence > t.next:
+		t.stats.Gaps++
+		t.stats.Lost += sequence - t.next
+		for s := t.next; s < sequence && len(t.missing) < maxMissing; s++ {
+			t.missing[s] = struct{}{}
+		}
+		t.next = sequence + 1
+		return SequenceGap
+	}
+	if _, ok := t.missing[sequence]; ok {
+		delete(t.missing, sequence)
+		t.stats.Lost--
+		t.stats.Reordered++
+		return SequenceReordered
+	}
+	t.stats.Duplicates++
+	return SequenceDuplicate
+}
+
+// Stats return the anomalies seen so far
+func (t *SequenceTracker) Stats() SequenceStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// SequenceSessions keep a tracker for each session. The least recently used trackers are forgotten
+// beyond maxSessions, only their stats are kept in the total.
+type SequenceSessions struct {
+	mu sync.Mutex
+	// order list the sessions from the least to the most recently used
+	order    *list.List
+	trackers map[string]*list.Element
+	// evicted count the forgotten sessions, evictedStats sum their stats
+	evicted      int
+	evictedStats SequenceStats
+}
+
+type sessionTracker struct {
+	session string
+	tracker *SequenceTracker
+}
+
+// NewSequenceSessions create an empty set of sessions
+func NewSequenceSessions() *SequenceSessions {
+	return &SequenceSessions{order: list.New(), trackers: make(map[string]*list.Element)}
+}
+
+// Tracker return the tracker of the session, created if needed
+func (s *SequenceSessions) Tracker(session string) *SequenceTracker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.trackers[session]; ok {
+		s.order.MoveToBack(e)
+		return e.Value.(*sessionTracker).tracker
+	}
+	t := NewSequenceTracker()
+	s.trackers[session] = s.order.PushBack(&sessionTracker{session: session, tracker: t})
+	if s.order.Len() > maxSessions {
+		oldest := s.order.Remove(s.order.Front()).(*sessionTracker)
+		delete(s.trackers, oldest.session)
+		s.evicted++
+		s.evictedStats.Add(oldest.tracker.Stats())
+	}
+	return t
+}
+
+// Each call fn with the stats of every tracked session, from the least to the most recently used
+func (s *SequenceSessions) Each(fn func(session string, stats SequenceStats)) {
+	s.mu.Lock()
+	trackers := make([]*sessionTracker, 0, s.order.Len())
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		trackers = append(trackers, e.Value.(*sessionTracker))
+	}
+	s.mu.Unlock()
+	for _, t := range trackers {
+		fn(t.session, t.tracker.Stats())
+	}
+}
+
+// Total return the number of sessions and the sum of their stats, forgotten sessions included
+func (s *SequenceSessions) Total() (sessions int, stats SequenceStats) {
+	s.mu.Lock()
+	sessions, stats = s.evicted, s.evictedStats
+	s.mu.Unlock()
+	s.Each(func(_ string, st SequenceStats) {
+		sessions++
+		stats.Add(st)
+	})
+	return sessions, stats
+}
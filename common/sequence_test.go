@@ -0,0 +1,66 @@
+package common
+
+import "testing"
+
+func TestSequenceTrackerObserve(t *testing.T) {
+	tests := []struct {
+		name      string
+		sequences []uint64
+		events    []SequenceEvent
+		stats     SequenceStats
+	}{
+		{
+			name:      "in order",
+			sequences: []uint64{1, 2, 3},
+			events:    []SequenceEvent{SequenceInOrder, SequenceInOrder, SequenceInOrder},
+			stats:     SequenceStats{Received: 3},
+		},
+		{
+			name:      "gap",
+			sequences: []uint64{1, 4, 5},
+			events:    []SequenceEvent{SequenceInOrder, SequenceGap, SequenceInOrder},
+			stats:     SequenceStats{Received: 3, Gaps: 1, Lost: 2},
+		},
+		{
+			name:      "reordered",
+			sequences: []uint64{1, 3, 2, 4},
+			events:    []SequenceEvent{SequenceInOrder, SequenceGap, SequenceReordered, SequenceInOrder},
+			stats:     SequenceStats{Received: 4, Gaps: 1, Reordered: 1},
+		},
+		{
+			name:      "duplicate",
+			sequences: []uint64{1, 2, 2, 1},
+			events:    []SequenceEvent{SequenceInOrder, SequenceInOrder, SequenceDuplicate, SequenceDuplicate},
+			stats:     SequenceStats{Received: 4, Duplicates: 2},
+		},
+		{
+			name:      "reordered twice",
+			sequences: []uint64{3, 1, 1},
+			events:    []SequenceEvent{SequenceGap, SequenceReordered, SequenceDuplicate},
+			stats:     SequenceStats{Received: 3, Gaps: 1, Lost: 1, Reordered: 1, Duplicates: 1},
+		},
+		{
+			name: "missing beyond the cap",
+			// only the first maxMissing numbers are remembered, a later one arriving late is a duplicate
+			sequences: []uint64{maxMissing + 11, 1, maxMissing + 5},
+			events:    []SequenceEvent{SequenceGap, SequenceReordered, SequenceDuplicate},
+			stats:     SequenceStats{Received: 3, Gaps: 1, Lost: maxMissing + 9, Reordered: 1, Duplicates: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewSequenceTracker()
+			for i, sequence := range tt.sequences {
+				if got := tracker.Observe(sequence); got != tt.events[i] {
+					t.Errorf("Observe(%d) = %s, want %s", sequence, got, tt.events[i])
+				}
+			}
+			if got := tracker.Stats(); got != tt.stats {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.stats)
+			}
+			if len(tracker.missing) > maxMissing {
+				t.Errorf("%d missing numbers remembered, want at most %d", len(tracker.missing), maxMissing)
+			}
+		})
+	}
+}
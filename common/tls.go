@@ -0,0 +1,81 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	keyTLS           = "tls"
+	keyTLSCert       = "tls_cert"
+	keyTLSKey        = "tls_key"
+	keyTLSCA         = "tls_ca"
+	keyTLSServerName = "tls_server_name"
+)
+
+// ServerCredentials return the server transport credentials, nil if no certificate is configured.
+// When a CA bundle is set, clients must present a certificate signed by it.
+func ServerCredentials() (credentials.TransportCredentials, error) {
+	certFile, keyFile := viper.GetString(keyTLSCert), viper.GetString(keyTLSKey)
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't load server certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if caFile := viper.GetString(keyTLSCA); len(caFile) > 0 {
+		if config.ClientCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// ClientCredentials return the client transport credentials, nil if TLS isn't enabled.
+// Without a CA bundle, the server certificate is verified against the system roots.
+func ClientCredentials() (credentials.TransportCredentials, error) {
+	caFile := viper.GetString(keyTLSCA)
+	if !viper.GetBool(keyTLS) && len(caFile) == 0 {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: viper.GetString(keyTLSServerName),
+	}
+	var err error
+	if len(caFile) > 0 {
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	certFile, keyFile := viper.GetString(keyTLSCert), viper.GetString(keyTLSKey)
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Can't load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read CA bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("No certificate found in %q", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+)
+
+const (
+	// keyListen replace the TCP port of the server by an address, like unix:/run/grpctest.sock
+	keyListen = "listen"
+	// keySocketMode is the octal permissions of the unix socket files created by the server
+	keySocketMode = "socket_mode"
+
+	prefixUnix         = "unix:"
+	prefixUnixAbstract = "unix-abstract:"
+)
+
+// ListenAddress return the address the server listen on, LISTEN or the TCP port
+func ListenAddress(port int) string {
+	if addr := viper.GetString(keyListen); len(addr) > 0 {
+		return addr
+	}
+	return net.JoinHostPort("", strconv.Itoa(port))
+}
+
+// IsUnixAddress tell if addr is a unix: or unix-abstract: address
+func IsUnixAddress(addr string) bool {
+	return strings.HasPrefix(addr, prefixUnix) || strings.HasPrefix(addr, prefixUnixAbstract)
+}
+
+// SplitAddress return the network and the address of addr, a TCP host:port, a unix:path socket file,
+// unix:///absolute/path as in the gRPC naming, or a unix-abstract:name socket of the Linux abstract namespace
+func SplitAddress(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, prefixUnixAbstract):
+		// Go use a leading @ for the abstract namespace
+		return "unix", "@" + strings.TrimPrefix(addr, prefixUnixAbstract)
+	case strings.HasPrefix(addr, prefixUnix+"//"):
+		return "unix", strings.TrimPrefix(addr, prefixUnix+"//")
+	case strings.HasPrefix(addr, prefixUnix):
+		return "unix", strings.TrimPrefix(addr, prefixUnix)
+	default:
+		return "tcp", addr
+	}
+}
+
+// Listen listen on addr. A unix socket file left by a previous run is removed unless a server still
+// listen on it, and the new one get the SOCKET_MODE permissions if set.
+func Listen(addr string) (net.Listener, error) {
+	network, address := SplitAddress(addr)
+	if network != "unix" || strings.HasPrefix(address, "@") {
+		return net.Listen(network, address)
+	}
+
+	var mode os.FileMode
+	if s := viper.GetString(keySocketMode); len(s) > 0 {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid socket mode %q", s)
+		}
+		mode = os.FileMode(m)
+	}
+	if fi, err := os.Stat(address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("Can't listen on %s, it isn't a socket", address)
+		}
+		conn, err := net.Dial(network, address)
+		if err == nil {
+			conn.Close()
+			return nil, errors.Errorf("Can't listen on %s, a server is listening on it", address)
+		}
+		if !isConnRefused(err) {
+			return nil, errors.Wrapf(err, "Can't check the socket %s", address)
+		}
+		// nobody listen, the socket was left by a previous run
+		if err = os.Remove(address); err != nil {
+			return nil, err
+		}
+	}
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err = os.Chmod(address, mode); err != nil {
+			lis.Close()
+			return nil, errors.Wrap(err, "Can't set socket mode")
+		}
+	}
+	return lis, nil
+}
+
+// isConnRefused tell if err is a dial refused as nobody listen
+func isConnRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// DialContext connect to addr, a TCP or a unix address
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	network, address := SplitAddress(addr)
+	return d.DialContext(ctx, network, address)
+}
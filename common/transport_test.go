@@ -0,0 +1,27 @@
+package common
+
+import "testing"
+
+func TestSplitAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+	}{
+		{addr: ":8080", network: "tcp", address: ":8080"},
+		{addr: "localhost:8080", network: "tcp", address: "localhost:8080"},
+		{addr: "[::1]:8080", network: "tcp", address: "[::1]:8080"},
+		{addr: "unix:/run/grpctest.sock", network: "unix", address: "/run/grpctest.sock"},
+		{addr: "unix:grpctest.sock", network: "unix", address: "grpctest.sock"},
+		{addr: "unix:///run/grpctest.sock", network: "unix", address: "/run/grpctest.sock"},
+		{addr: "unix-abstract:grpctest", network: "unix", address: "@grpctest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			network, address := SplitAddress(tt.addr)
+			if network != tt.network || address != tt.address {
+				t.Errorf("SplitAddress(%q) = %q, %q, want %q, %q", tt.addr, network, address, tt.network, tt.address)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// WatchFile call fn once path stayed unchanged for delay after it was written or created. The directory
+// is watched so the file can be replaced by a rename.
+func WatchFile(path string, delay time.Duration, fn func(), log *zap.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		// editors write a file in several steps, wait for it to settle
+		debounce := time.AfterFunc(time.Hour, fn)
+		debounce.Stop()
+		for {
+			select {
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) == filepath.Clean(path) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					debounce.Reset(delay)
+				}
+			case err := <-watcher.Errors:
+				log.Error("Error watching file", zap.Error(err), zap.String("path", path))
+			}
+		}
+	}()
+	return nil
+}
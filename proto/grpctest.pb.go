@@ -35,6 +35,16 @@ const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Request struct {
 	Value string `protobuf:"bytes,1,opt,name=value" json:"value,omitempty"`
+	// session_id identify the sender of a sequence of messages, it's kept across reconnects
+	SessionId string `protobuf:"bytes,2,opt,name=session_id,json=sessionId" json:"session_id,omitempty"`
+	// sequence start at 1 and increase by one for each message of the session
+	Sequence uint64 `protobuf:"varint,3,opt,name=sequence" json:"sequence,omitempty"`
+	// sent_at is the send time, in nanoseconds since the Unix epoch
+	SentAt int64 `protobuf:"varint,4,opt,name=sent_at,json=sentAt" json:"sent_at,omitempty"`
+	// payload is filler data, to test big messages
+	Payload []byte `protobuf:"bytes,5,opt,name=payload,proto3" json:"payload,omitempty"`
+	// checksum is the big-endian CRC-32C of the payload, empty if it must not be verified
+	Checksum []byte `protobuf:"bytes,6,opt,name=checksum,proto3" json:"checksum,omitempty"`
 }
 
 func (m *Request) Reset()                    { *m = Request{} }
@@ -49,8 +59,61 @@ func (m *Request) GetValue() string {
 	return ""
 }
 
+func (m *Request) GetSessionId() string {
+	if m != nil {
+		return m.SessionId
+	}
+	return ""
+}
+
+func (m *Request) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *Request) GetSentAt() int64 {
+	if m != nil {
+		return m.SentAt
+	}
+	return 0
+}
+
+func (m *Request) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *Request) GetChecksum() []byte {
+	if m != nil {
+		return m.Checksum
+	}
+	return nil
+}
+
 type Response struct {
-	Value string `protobuf:"bytes,1,opt,name=value" json:"value,omitempty"`
+	Value     string `protobuf:"bytes,1,opt,name=value" json:"value,omitempty"`
+	SessionId string `protobuf:"bytes,2,opt,name=session_id,json=sessionId" json:"session_id,omitempty"`
+	Sequence  uint64 `protobuf:"varint,3,opt,name=sequence" json:"sequence,omitempty"`
+	SentAt    int64  `protobuf:"varint,4,opt,name=sent_at,json=sentAt" json:"sent_at,omitempty"`
+	Payload   []byte `protobuf:"bytes,5,opt,name=payload,proto3" json:"payload,omitempty"`
+	Checksum  []byte `protobuf:"bytes,6,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	// message_count, total_bytes and digest summarize the requests of a client stream
+	MessageCount uint64 `protobuf:"varint,7,opt,name=message_count,json=messageCount" json:"message_count,omitempty"`
+	// total_bytes is the sum of the payload sizes
+	TotalBytes uint64 `protobuf:"varint,8,opt,name=total_bytes,json=totalBytes" json:"total_bytes,omitempty"`
+	// digest is the SHA-256 of the values of all requests, each followed by a new line
+	Digest []byte `protobuf:"bytes,9,opt,name=digest,proto3" json:"digest,omitempty"`
+	// instance is the ID of the server instance that sent the response
+	Instance string `protobuf:"bytes,10,opt,name=instance" json:"instance,omitempty"`
+	// compressor is the compression of the request seen by the server, identity when uncompressed
+	Compressor string `protobuf:"bytes,11,opt,name=compressor" json:"compressor,omitempty"`
+	// deadline_remaining is the time left before the deadline of the call when the server received it,
+	// in nanoseconds, 0 if the call has no deadline
+	DeadlineRemaining int64 `protobuf:"varint,12,opt,name=deadline_remaining,json=deadlineRemaining" json:"deadline_remaining,omitempty"`
 }
 
 func (m *Response) Reset()                    { *m = Response{} }
@@ -65,6 +128,83 @@ func (m *Response) GetValue() string {
 	return ""
 }
 
+func (m *Response) GetSessionId() string {
+	if m != nil {
+		return m.SessionId
+	}
+	return ""
+}
+
+func (m *Response) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *Response) GetSentAt() int64 {
+	if m != nil {
+		return m.SentAt
+	}
+	return 0
+}
+
+func (m *Response) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *Response) GetChecksum() []byte {
+	if m != nil {
+		return m.Checksum
+	}
+	return nil
+}
+
+func (m *Response) GetMessageCount() uint64 {
+	if m != nil {
+		return m.MessageCount
+	}
+	return 0
+}
+
+func (m *Response) GetTotalBytes() uint64 {
+	if m != nil {
+		return m.TotalBytes
+	}
+	return 0
+}
+
+func (m *Response) GetDigest() []byte {
+	if m != nil {
+		return m.Digest
+	}
+	return nil
+}
+
+func (m *Response) GetInstance() string {
+	if m != nil {
+		return m.Instance
+	}
+	return ""
+}
+
+func (m *Response) GetCompressor() string {
+	if m != nil {
+		return m.Compressor
+	}
+	return ""
+}
+
+func (m *Response) GetDeadlineRemaining() int64 {
+	if m != nil {
+		return m.DeadlineRemaining
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Request)(nil), "grpctest.Request")
 	proto.RegisterType((*Response)(nil), "grpctest.Response")
@@ -338,19 +478,31 @@ var _GrpcTest_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("grpctest.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 213 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x4b, 0x2f, 0x2a, 0x48,
-	0x2e, 0x49, 0x2d, 0x2e, 0xd1, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x80, 0xf1, 0x95, 0xe4,
-	0xb9, 0xd8, 0x83, 0x52, 0x0b, 0x4b, 0x53, 0x8b, 0x4b, 0x84, 0x44, 0xb8, 0x58, 0xcb, 0x12, 0x73,
-	0x4a, 0x53, 0x25, 0x18, 0x15, 0x18, 0x35, 0x38, 0x83, 0x20, 0x1c, 0x25, 0x05, 0x2e, 0x8e, 0xa0,
-	0xd4, 0xe2, 0x82, 0xfc, 0xbc, 0xe2, 0x54, 0xec, 0x2a, 0x8c, 0xde, 0x31, 0x72, 0x71, 0xb8, 0x17,
-	0x15, 0x24, 0x87, 0x80, 0x0c, 0x31, 0xe7, 0xe2, 0x71, 0xce, 0xc9, 0x4c, 0xcd, 0x2b, 0x09, 0x2e,
-	0x29, 0x4a, 0x4d, 0xcc, 0x15, 0x12, 0xd4, 0x83, 0x5b, 0x0d, 0xb5, 0x47, 0x4a, 0x08, 0x59, 0x08,
-	0x62, 0xb2, 0x06, 0x23, 0x48, 0x63, 0x70, 0x6a, 0x51, 0x59, 0x6a, 0x11, 0x49, 0x1a, 0x0d, 0x18,
-	0x85, 0x1c, 0xb8, 0x84, 0x9d, 0x32, 0x5d, 0x32, 0x8b, 0x52, 0x93, 0x4b, 0x32, 0xf3, 0xf3, 0x12,
-	0x73, 0x48, 0xb4, 0xd8, 0x80, 0x51, 0x48, 0x8f, 0x8b, 0x35, 0x34, 0x2f, 0xb1, 0xa8, 0x92, 0x48,
-	0x3d, 0x4e, 0x7a, 0x51, 0x3a, 0xe9, 0x99, 0x25, 0x19, 0xa5, 0x49, 0x7a, 0xc9, 0xf9, 0xb9, 0xfa,
-	0x49, 0xc9, 0x39, 0xa9, 0x45, 0xb9, 0xf9, 0x79, 0x25, 0xfa, 0x30, 0x95, 0xfa, 0xe0, 0x40, 0xb6,
-	0x86, 0x71, 0x93, 0xd8, 0xc0, 0x7c, 0x63, 0x40, 0x00, 0x00, 0x00, 0xff, 0xff, 0x73, 0x50, 0x57,
-	0xd0, 0x86, 0x01, 0x00, 0x00,
+	// 403 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xcc, 0x93, 0x41, 0x6f, 0xd4, 0x30,
+	0x10, 0x85, 0xe5, 0xb6, 0xbb, 0x9b, 0x9d, 0x2e, 0x48, 0x35, 0x08, 0xac, 0x4a, 0xc0, 0xaa, 0x5c,
+	0x72, 0x80, 0x6c, 0x05, 0x07, 0x0e, 0x5c, 0x60, 0x8b, 0x84, 0xb8, 0xa6, 0x70, 0xe1, 0x12, 0x79,
+	0x9d, 0x51, 0x6a, 0x91, 0xd8, 0xc1, 0x33, 0xa9, 0xb4, 0x3f, 0x89, 0x3f, 0xc7, 0x85, 0x3f, 0x80,
+	0xec, 0x6e, 0x56, 0x3d, 0xb2, 0x37, 0x8e, 0xdf, 0x7b, 0x7e, 0x7e, 0x19, 0x65, 0x0c, 0x0f, 0x9b,
+	0xd0, 0x1b, 0x46, 0xe2, 0xa2, 0x0f, 0x9e, 0xbd, 0xcc, 0x46, 0xbe, 0xf8, 0x25, 0x60, 0x56, 0xe2,
+	0xcf, 0x01, 0x89, 0xe5, 0x63, 0x98, 0xdc, 0xea, 0x76, 0x40, 0x25, 0x96, 0x22, 0x9f, 0x97, 0x77,
+	0x20, 0x9f, 0x01, 0x10, 0x12, 0x59, 0xef, 0x2a, 0x5b, 0xab, 0xa3, 0x64, 0xcd, 0x77, 0xca, 0x97,
+	0x5a, 0x9e, 0x43, 0x46, 0x31, 0xef, 0x0c, 0xaa, 0xe3, 0xa5, 0xc8, 0x4f, 0xca, 0x3d, 0xcb, 0xa7,
+	0x30, 0x23, 0x74, 0x5c, 0x69, 0x56, 0x27, 0x4b, 0x91, 0x1f, 0x97, 0xd3, 0x88, 0x1f, 0x59, 0x2a,
+	0x98, 0xf5, 0x7a, 0xdb, 0x7a, 0x5d, 0xab, 0xc9, 0x52, 0xe4, 0x8b, 0x72, 0xc4, 0x78, 0x9d, 0xb9,
+	0x41, 0xf3, 0x83, 0x86, 0x4e, 0x4d, 0x93, 0xb5, 0xe7, 0x8b, 0x3f, 0x47, 0x90, 0x95, 0x48, 0xbd,
+	0x77, 0x84, 0xff, 0xfb, 0xc7, 0xca, 0x97, 0xf0, 0xa0, 0x43, 0x22, 0xdd, 0x60, 0x65, 0xfc, 0xe0,
+	0x58, 0xcd, 0x52, 0xdf, 0x62, 0x27, 0x5e, 0x45, 0x4d, 0xbe, 0x80, 0x53, 0xf6, 0xac, 0xdb, 0x6a,
+	0xb3, 0x65, 0x24, 0x95, 0xa5, 0x23, 0x90, 0xa4, 0x75, 0x54, 0xe4, 0x13, 0x98, 0xd6, 0xb6, 0x41,
+	0x62, 0x35, 0x4f, 0xf7, 0xef, 0x28, 0x36, 0x5b, 0x47, 0xac, 0xe3, 0x20, 0x90, 0xa6, 0xdc, 0xb3,
+	0x7c, 0x0e, 0x60, 0x7c, 0xd7, 0x07, 0x24, 0xf2, 0x41, 0x9d, 0x26, 0xf7, 0x9e, 0x22, 0x5f, 0x83,
+	0xac, 0x51, 0xd7, 0xad, 0x75, 0x58, 0x05, 0xec, 0xb4, 0x75, 0xd6, 0x35, 0x6a, 0x91, 0x66, 0x3e,
+	0x1b, 0x9d, 0x72, 0x34, 0xde, 0xfc, 0x16, 0x90, 0x7d, 0x0e, 0xbd, 0xf9, 0x1a, 0x7b, 0xdf, 0xc1,
+	0xe2, 0xaa, 0xb5, 0xe8, 0xf8, 0x9a, 0x03, 0xea, 0x4e, 0x9e, 0x15, 0xfb, 0xcd, 0xda, 0x6d, 0xd1,
+	0xb9, 0xbc, 0x2f, 0xdd, 0xfd, 0xac, 0x5c, 0xc4, 0xe0, 0x35, 0x86, 0x5b, 0x0c, 0x07, 0x05, 0x2f,
+	0x85, 0xfc, 0x00, 0x8f, 0xd6, 0xf6, 0x93, 0x0d, 0x68, 0xd8, 0x7a, 0xa7, 0xdb, 0x03, 0x8b, 0x2f,
+	0x85, 0x2c, 0x60, 0xf2, 0xcd, 0xe9, 0xb0, 0xfd, 0xc7, 0xcc, 0xba, 0xf8, 0xfe, 0xaa, 0xb1, 0x7c,
+	0x33, 0x6c, 0x0a, 0xe3, 0xbb, 0xd5, 0xc6, 0xb4, 0x18, 0x3a, 0xef, 0x78, 0x35, 0x9e, 0x5c, 0xa5,
+	0x37, 0xf4, 0x7e, 0xc4, 0xcd, 0x34, 0xf1, 0xdb, 0xbf, 0x03, 0x00, 0x6a, 0xab, 0x91, 0x9a, 0x65,
+	0x03, 0x00, 0x00,
 }
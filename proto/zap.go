@@ -1,6 +1,8 @@
 package grpctest
 
 import (
+	"time"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -8,11 +10,22 @@ import (
 func (r *Request) ZapFields() []zapcore.Field {
 	return []zapcore.Field{
 		zap.String("value", r.Value),
+		zap.String("session", r.SessionId),
+		zap.Uint64("sequence", r.Sequence),
+		zap.Time("sent_at", time.Unix(0, r.SentAt)),
+		zap.Int("payload_bytes", len(r.Payload)),
 	}
 }
 
 func (r *Response) ZapFields() []zapcore.Field {
 	return []zapcore.Field{
 		zap.String("value", r.Value),
+		zap.String("session", r.SessionId),
+		zap.Uint64("sequence", r.Sequence),
+		zap.Time("sent_at", time.Unix(0, r.SentAt)),
+		zap.Int("payload_bytes", len(r.Payload)),
+		zap.String("instance", r.Instance),
+		zap.String("compressor", r.Compressor),
+		zap.Duration("deadline_remaining", time.Duration(r.DeadlineRemaining)),
 	}
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/yaml.v2"
+)
+
+// startAdmin serve the admin HTTP API if an address is configured
+func startAdmin(addr string, mux *http.ServeMux, log *zap.Logger) {
+	if len(addr) == 0 {
+		return
+	}
+	log.Info("Listen admin", zap.String("address", addr))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("Can't serve admin", zap.Error(err), zap.String("address", addr))
+		}
+	}()
+}
+
+// chaosHandler show the chaos profile on GET, replace it on PUT and disable it on DELETE
+func chaosHandler(c *chaos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeYAML(w, c.get())
+		case http.MethodPut, http.MethodPost:
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			profile, err := parseChaosProfile(data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.set(profile)
+			c.log.Info("Chaos profile replaced", zap.ByteString("profile", data))
+			writeYAML(w, profile)
+		case http.MethodDelete:
+			c.set(nil)
+			c.log.Info("Chaos disabled")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// healthHandler show the serving status of every service of an instance on GET, and change the status of
+// the service parameter, the server by default, to the status parameter on PUT. The instance parameter
+// select the instance, the first one by default.
+func healthHandler(instances []*instance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.FormValue("instance")
+		if len(id) == 0 {
+			id = instances[0].id
+		}
+		i, ok := findInstance(instances, id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown instance %q", id), http.StatusNotFound)
+			return
+		}
+		h := i.healthServer()
+		if h == nil {
+			http.Error(w, fmt.Sprintf("Instance %s is stopped", id), http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeYAML(w, h.get())
+		case http.MethodPut, http.MethodPost:
+			service := r.FormValue("service")
+			status, ok := healthpb.HealthCheckResponse_ServingStatus_value[strings.ToUpper(r.FormValue("status"))]
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unknown status %q", r.FormValue("status")), http.StatusBadRequest)
+				return
+			}
+			h.set(service, healthpb.HealthCheckResponse_ServingStatus(status))
+			writeYAML(w, h.get())
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// instancesHandler show the instances on GET, and apply the action parameter to the instance
+// of the id parameter on POST: pause, resume, drain, kill or start
+func instancesHandler(instances []*instance, drainTimeout time.Duration) http.HandlerFunc {
+	list := func() []instanceStatus {
+		statuses := make([]instanceStatus, len(instances))
+		for n, i := range instances {
+			statuses[n] = i.status()
+		}
+		return statuses
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeYAML(w, list())
+		case http.MethodPut, http.MethodPost:
+			i, ok := findInstance(instances, r.FormValue("id"))
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unknown instance %q", r.FormValue("id")), http.StatusNotFound)
+				return
+			}
+			var err error
+			switch action := r.FormValue("action"); action {
+			case "pause":
+				err = i.pause()
+			case "resume":
+				err = i.resume()
+			case "drain":
+				err = i.drainWithin(drainTimeout)
+			case "kill":
+				err = i.kill()
+			case "start":
+				err = i.start()
+			default:
+				http.Error(w, fmt.Sprintf("Unknown action %q, expected pause, resume, drain, kill or start", action), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			writeYAML(w, list())
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func writeYAML(w http.ResponseWriter, v interface{}) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(data)
+}
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"crypto/rand"
 	"io"
 	"time"
 
-	"github.com/oklog/ulid"
 	"github.com/prometheus/common/log"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/bclermont/grpctest/common"
 	grpctest "github.com/bclermont/grpctest/proto"
 )
 
-// BiDirectionalStream send response at some interval and log received request
+// BiDirectionalStream send response at some interval and log received request, until the client close the stream or the server shut down.
+// In echo mode, it send back every request instead.
 func (s *server) BiDirectionalStream(stream grpctest.GrpcTest_BiDirectionalStreamServer) error {
 	reqChan := make(chan *grpctest.Request, 1)
 	recvErrorChan := make(chan error, 1)
@@ -44,19 +44,29 @@ func (s *server) BiDirectionalStream(stream grpctest.GrpcTest_BiDirectionalStrea
 		}
 	}()
 
-	ticker := time.NewTicker(s.interval)
+	seq, err := common.NewSequencer()
+	if err != nil {
+		return err
+	}
+	var session string
+	defer func() { s.logSession(session) }()
+
+	echo := common.EchoCount(ctx) > 0
+	var tick <-chan time.Time
+	if !echo {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
 	for {
 		select {
-		case t := <-ticker.C:
+		case t := <-tick:
 			// send some dummy response
-			id, err := ulid.New(ulid.Timestamp(t), rand.Reader)
+			resp, err := s.newResponse(seq, t)
 			if err != nil {
 				return err
 			}
-			resp := &grpctest.Response{
-				Value: id.String(),
-			}
 			if err := stream.Send(resp); err != nil {
 				return err
 			}
@@ -70,16 +80,26 @@ func (s *server) BiDirectionalStream(stream grpctest.GrpcTest_BiDirectionalStrea
 			return recvErr
 		case <-ctx.Done():
 			s.log.Info("Context done, leaving", zap.Error(ctx.Err()))
-			ticker.Stop()
 			return ctx.Err()
+		case <-s.shutdown:
+			s.log.Info("Shutting down, end stream")
+			return nil
 		case req, isOpen := <-reqChan:
 			if !isOpen {
 				s.log.Debug("Channel closed, leaving")
-				ticker.Stop()
 				return nil
 			}
 			// process request
 			s.log.Debug("Request received", req.ZapFields()...)
+			s.observe(req)
+			session = req.SessionId
+			if echo {
+				resp := s.echoResponse(req, req.SessionId, req.Sequence)
+				if err := stream.Send(resp); err != nil {
+					return err
+				}
+				s.log.Debug("Sent echo response", resp.ZapFields()...)
+			}
 		}
 	}
 }
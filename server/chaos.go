@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+// Latency distributions
+const (
+	distributionFixed       = "fixed"
+	distributionUniform     = "uniform"
+	distributionExponential = "exponential"
+	distributionNormal      = "normal"
+)
+
+// latencyDistribution describe the random latency added to each message
+type latencyDistribution struct {
+	Distribution string        `yaml:"distribution"`
+	Min          time.Duration `yaml:"min,omitempty"`
+	Max          time.Duration `yaml:"max,omitempty"`
+	Mean         time.Duration `yaml:"mean,omitempty"`
+	StdDev       time.Duration `yaml:"stddev,omitempty"`
+}
+
+// chaosProfile describe the faults randomly injected in all calls
+type chaosProfile struct {
+	// FailurePercent is the percentage of calls failing immediately
+	FailurePercent float64 `yaml:"failure_percent"`
+	// Codes is the weight of each status code of the failures, Unavailable when empty
+	Codes map[string]int `yaml:"codes,omitempty"`
+	// Latency is added before each message
+	Latency *latencyDistribution `yaml:"latency,omitempty"`
+	// CancelPercent is the percentage of stream messages that abort their stream
+	CancelPercent float64 `yaml:"cancel_percent"`
+	// DropPercent is the percentage of calls that drop their connection
+	DropPercent float64 `yaml:"drop_percent"`
+	// GoAwayPercent is the percentage of calls that make their connection send a GOAWAY
+	GoAwayPercent float64 `yaml:"goaway_percent"`
+
+	codes   []codes.Code
+	weights []int
+	total   int
+}
+
+func (p *chaosProfile) init() error {
+	for _, percent := range []float64{p.FailurePercent, p.CancelPercent, p.DropPercent, p.GoAwayPercent} {
+		if percent < 0 || percent > 100 {
+			return errors.Errorf("Invalid percentage %v", percent)
+		}
+	}
+	if len(p.Codes) == 0 {
+		p.Codes = map[string]int{codes.Unavailable.String(): 1}
+	}
+	p.codes, p.weights, p.total = nil, nil, 0
+	for name, weight := range p.Codes {
+		code, err := common.ParseCode(name)
+		if err != nil {
+			return err
+		}
+		if weight <= 0 {
+			return errors.Errorf("Weight of %q must be positive", name)
+		}
+		p.codes = append(p.codes, code)
+		p.weights = append(p.weights, weight)
+		p.total += weight
+	}
+	if l := p.Latency; l != nil {
+		switch l.Distribution {
+		case distributionFixed, distributionExponential, distributionNormal:
+		case distributionUniform:
+			if l.Max < l.Min {
+				return errors.New("Uniform latency max must be greater than min")
+			}
+		default:
+			return errors.Errorf("Unknown latency distribution %q", l.Distribution)
+		}
+	}
+	return nil
+}
+
+func parseChaosProfile(data []byte) (*chaosProfile, error) {
+	p := &chaosProfile{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, errors.Wrap(err, "Can't parse chaos profile")
+	}
+	return p, p.init()
+}
+
+func loadChaosProfile(path string) (*chaosProfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read chaos profile")
+	}
+	return parseChaosProfile(data)
+}
+
+func chance(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// code pick a failure status code following the weights
+func (p *chaosProfile) code() codes.Code {
+	n := rand.Intn(p.total)
+	for i, w := range p.weights {
+		if n < w {
+			return p.codes[i]
+		}
+		n -= w
+	}
+	return p.codes[len(p.codes)-1]
+}
+
+// latency pick a random latency following the distribution
+func (p *chaosProfile) latency() time.Duration {
+	l := p.Latency
+	if l == nil {
+		return 0
+	}
+	var d time.Duration
+	switch l.Distribution {
+	case distributionFixed:
+		d = l.Mean
+	case distributionUniform:
+		d = l.Min + time.Duration(rand.Int63n(int64(l.Max-l.Min)+1))
+	case distributionExponential:
+		d = l.Min + time.Duration(rand.ExpFloat64()*float64(l.Mean))
+	case distributionNormal:
+		d = time.Duration(rand.NormFloat64()*float64(l.StdDev) + float64(l.Mean))
+	}
+	if l.Max > 0 {
+		d = time.Duration(math.Min(float64(d), float64(l.Max)))
+	}
+	if d < l.Min {
+		d = l.Min
+	}
+	return d
+}
+
+// chaos inject the faults of the current profile, the profile can be replaced at any time
+type chaos struct {
+	log     *zap.Logger
+	profile atomic.Value
+	conns   *connTracker
+}
+
+func newChaos(profile *chaosProfile, conns *connTracker, log *zap.Logger) *chaos {
+	c := &chaos{log: log, conns: conns}
+	c.set(profile)
+	return c
+}
+
+// get return the current profile, nil if chaos is disabled
+func (c *chaos) get() *chaosProfile {
+	return c.profile.Load().(*chaosProfile)
+}
+
+// set replace the profile, nil disable chaos
+func (c *chaos) set(profile *chaosProfile) {
+	c.profile.Store(profile)
+}
+
+// start decide the faults injected when a call start, it return the error ending the call if any
+func (c *chaos) start(ctx context.Context, p *chaosProfile, method string) error {
+	log := c.log.With(zap.String("method", method))
+	if chance(p.DropPercent) {
+		if pr, ok := peer.FromContext(ctx); ok && c.conns.drop(pr.Addr) {
+			err := status.Error(codes.Unavailable, "Chaos connection drop")
+			log.Info("Chaos dropped connection", append(common.GrpcErrorFields(err), zap.Stringer("peer", pr.Addr))...)
+			return err
+		}
+	}
+	if chance(p.GoAwayPercent) {
+		if pr, ok := peer.FromContext(ctx); ok && c.conns.goAway(pr.Addr) {
+			// the call go on, the calls started by the client before it get the GOAWAY fail with this error
+			err := status.Error(codes.Unavailable, "Chaos GOAWAY")
+			log.Info("Chaos sent GOAWAY", append(common.GrpcErrorFields(err), zap.Stringer("peer", pr.Addr))...)
+		}
+	}
+	if chance(p.FailurePercent) {
+		err := status.Error(p.code(), "Chaos failure")
+		log.Info("Chaos failure", common.GrpcErrorFields(err)...)
+		return err
+	}
+	return c.delay(ctx, p, log)
+}
+
+func (c *chaos) delay(ctx context.Context, p *chaosProfile, log *zap.Logger) error {
+	d := p.latency()
+	if d <= 0 {
+		return nil
+	}
+	log.Debug("Chaos latency", zap.Duration("latency", d))
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UnaryServerInterceptor inject chaos in unary calls
+func (c *chaos) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		p := c.get()
+		if p == nil {
+			return handler(ctx, req)
+		}
+		if err := c.start(ctx, p, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor inject chaos in streams, latency and cancellation are applied to each message
+func (c *chaos) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		p := c.get()
+		if p == nil {
+			return handler(srv, ss)
+		}
+		if err := c.start(ss.Context(), p, info.FullMethod); err != nil {
+			return err
+		}
+		ctx, cancelFn := context.WithCancel(ss.Context())
+		defer cancelFn()
+		cs := &chaosStream{
+			ServerStream: ss,
+			ctx:          ctx,
+			cancelFn:     cancelFn,
+			chaos:        c,
+			profile:      p,
+			log:          c.log.With(zap.String("method", info.FullMethod)),
+		}
+		err := handler(srv, cs)
+		if injected := cs.injected(); injected != nil {
+			return injected
+		}
+		return err
+	}
+}
+
+// chaosStream delay messages and randomly abort the stream
+type chaosStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	cancelFn context.CancelFunc
+	chaos    *chaos
+	profile  *chaosProfile
+	log      *zap.Logger
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *chaosStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *chaosStream) injected() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// message apply the chaos to a message, it return the error aborting the stream if any
+func (s *chaosStream) message() error {
+	if err := s.injected(); err != nil {
+		return err
+	}
+	if chance(s.profile.CancelPercent) {
+		err := status.Error(codes.Aborted, "Chaos stream cancellation")
+		s.log.Info("Chaos cancelled stream", common.GrpcErrorFields(err)...)
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		s.cancelFn()
+		return err
+	}
+	return s.chaos.delay(s.ctx, s.profile, s.log)
+}
+
+func (s *chaosStream) SendMsg(m interface{}) error {
+	if err := s.message(); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *chaosStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.message()
+}
+
+// connTracker keep the accepted connections of every listener so chaos can drop them or send a GOAWAY
+type connTracker struct {
+	// tls is set when the connections are encrypted, their GOAWAY is then sent after the TLS handshake
+	tls bool
+
+	mu      sync.Mutex
+	conns   map[string]net.Conn
+	goAways map[string]*goAwayConn
+}
+
+func newConnTracker(tls bool) *connTracker {
+	return &connTracker{tls: tls, conns: make(map[string]net.Conn), goAways: make(map[string]*goAwayConn)}
+}
+
+// trackGoAway return conn able to send a GOAWAY, conn must carry the HTTP/2 frames in clear
+func (t *connTracker) trackGoAway(conn net.Conn) net.Conn {
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		return conn
+	}
+	g := &goAwayConn{Conn: conn}
+	t.mu.Lock()
+	t.goAways[conn.RemoteAddr().String()] = g
+	t.mu.Unlock()
+	return g
+}
+
+// goAway make the connection from addr send a GOAWAY, it return false if it's unknown
+func (t *connTracker) goAway(addr net.Addr) bool {
+	t.mu.Lock()
+	conn, ok := t.goAways[addr.String()]
+	t.mu.Unlock()
+	if ok {
+		conn.goAway()
+	}
+	return ok
+}
+
+// drop close abruptly the connection from addr, it return false if it's unknown
+func (t *connTracker) drop(addr net.Addr) bool {
+	t.mu.Lock()
+	conn, ok := t.conns[addr.String()]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if tcp, ok := conn.(*trackedConn).Conn.(*net.TCPConn); ok {
+		// reset rather than close gracefully
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+	return true
+}
+
+// trackingListener add its accepted TCP connections to a tracker, unix sockets have no distinct peer address
+type trackingListener struct {
+	net.Listener
+	conns *connTracker
+}
+
+func newTrackingListener(lis net.Listener, conns *connTracker) *trackingListener {
+	return &trackingListener{Listener: lis, conns: conns}
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		return conn, nil
+	}
+	tc := &trackedConn{Conn: conn, tracker: l.conns}
+	l.conns.mu.Lock()
+	l.conns.conns[conn.RemoteAddr().String()] = tc
+	l.conns.mu.Unlock()
+	if l.conns.tls {
+		return tc, nil
+	}
+	return l.conns.trackGoAway(tc), nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.mu.Lock()
+		delete(c.tracker.conns, c.RemoteAddr().String())
+		delete(c.tracker.goAways, c.RemoteAddr().String())
+		c.tracker.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// chaosCredentials track the connections after the TLS handshake, so they can send a GOAWAY
+type chaosCredentials struct {
+	credentials.TransportCredentials
+	conns *connTracker
+}
+
+func (c *chaosCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.conns.trackGoAway(conn), info, nil
+}
+
+func (c *chaosCredentials) Clone() credentials.TransportCredentials {
+	return &chaosCredentials{TransportCredentials: c.TransportCredentials.Clone(), conns: c.conns}
+}
+
+// goAwayFrame tell the client to open a new connection for its next calls, the running ones go on
+var goAwayFrame = func() []byte {
+	var buf bytes.Buffer
+	http2.NewFramer(&buf, nil).WriteGoAway(math.MaxInt32, http2.ErrCodeNo, nil)
+	return buf.Bytes()
+}()
+
+// goAwayConn insert a GOAWAY between the HTTP/2 frames written by the server when asked, as
+// a graceful stop does for a single connection
+type goAwayConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	pending bool
+	frames  frameScanner
+}
+
+func (c *goAwayConn) goAway() {
+	c.mu.Lock()
+	c.pending = true
+	c.mu.Unlock()
+}
+
+func (c *goAwayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pending {
+		c.frames.scan(p)
+		return c.Conn.Write(p)
+	}
+	// write up to the end of the current frame, the GOAWAY and then the rest
+	k := 0
+	if !c.frames.boundary() {
+		k = c.frames.next(p)
+	}
+	if !c.frames.boundary() {
+		return c.Conn.Write(p)
+	}
+	n, err := c.Conn.Write(p[:k])
+	if err != nil {
+		return n, err
+	}
+	if _, err = c.Conn.Write(goAwayFrame); err != nil {
+		return n, err
+	}
+	c.pending = false
+	c.frames.scan(p[k:])
+	m, err := c.Conn.Write(p[k:])
+	return n + m, err
+}
+
+// frameScanner follow the boundaries of a sequence of HTTP/2 frames
+type frameScanner struct {
+	header [9]byte
+	// read is the number of bytes of the header read, left the number of bytes of the payload to read
+	read int
+	left int
+}
+
+func (f *frameScanner) boundary() bool {
+	return f.read == 0 && f.left == 0
+}
+
+// next read p up to the next frame boundary, it return the number of bytes read
+func (f *frameScanner) next(p []byte) int {
+	i := 0
+	for i < len(p) {
+		if f.left > 0 {
+			n := len(p) - i
+			if n > f.left {
+				n = f.left
+			}
+			f.left -= n
+			i += n
+			if f.left == 0 {
+				return i
+			}
+			continue
+		}
+		f.header[f.read] = p[i]
+		f.read++
+		i++
+		if f.read == len(f.header) {
+			f.read = 0
+			f.left = int(f.header[0])<<16 | int(f.header[1])<<8 | int(f.header[2])
+			if f.left == 0 {
+				return i
+			}
+		}
+	}
+	return i
+}
+
+// scan read all of p
+func (f *frameScanner) scan(p []byte) {
+	for len(p) > 0 {
+		p = p[f.next(p):]
+	}
+}
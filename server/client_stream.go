@@ -2,11 +2,13 @@ package main
 
 import (
 	"io"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/bclermont/grpctest/common"
 	grpctest "github.com/bclermont/grpctest/proto"
 	"github.com/prometheus/common/log"
 )
@@ -41,11 +43,31 @@ func (s *server) ClientStream(stream grpctest.GrpcTest_ClientStreamServer) error
 		}
 	}()
 
+	var session string
+	defer func() { s.logSession(session) }()
+	digest := common.NewDigest()
+	// sendSummary end the stream with a summary of the received requests, for the client to verify
+	sendSummary := func() error {
+		resp := &grpctest.Response{
+			SessionId:    session,
+			SentAt:       time.Now().UnixNano(),
+			MessageCount: digest.Count,
+			TotalBytes:   digest.Bytes,
+			Digest:       digest.Sum(),
+			Instance:     s.instance,
+		}
+		s.log.Debug("Send aggregate response", zap.Uint64("messages", resp.MessageCount), zap.Uint64("bytes", resp.TotalBytes))
+		return stream.SendAndClose(resp)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			s.log.Info("Context done, leaving", zap.Error(ctx.Err()))
 			return ctx.Err()
+		case <-s.shutdown:
+			s.log.Info("Shutting down, end stream")
+			return sendSummary()
 		case recvErr, isOpen := <-recvErrorChan:
 			if !isOpen {
 				s.log.Debug("Error channel closed")
@@ -55,11 +77,14 @@ func (s *server) ClientStream(stream grpctest.GrpcTest_ClientStreamServer) error
 			return recvErr
 		case req, isOpen := <-reqChan:
 			if !isOpen {
-				s.log.Debug("Channel closed, leaving")
-				return nil
+				s.log.Debug("Channel closed")
+				return sendSummary()
 			}
 			// process request
 			s.log.Debug("Request received", req.ZapFields()...)
+			s.observe(req)
+			session = req.SessionId
+			digest.Add(req.Value, req.Payload)
 		}
 	}
 }
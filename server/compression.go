@@ -0,0 +1,72 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+
+	"github.com/bclermont/grpctest/common"
+	grpctest "github.com/bclermont/grpctest/proto"
+)
+
+type compressorKey struct{}
+
+// compressionHandler record the compressor of the requests of every call, it's only known by the transport
+type compressionHandler struct{}
+
+func (compressionHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	name := common.CompressorIdentity
+	return context.WithValue(ctx, compressorKey{}, &name)
+}
+
+func (compressionHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if h, ok := s.(*stats.InHeader); ok && len(h.Compression) > 0 {
+		if name, ok := ctx.Value(compressorKey{}).(*string); ok {
+			*name = h.Compression
+		}
+	}
+}
+
+func (compressionHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (compressionHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// requestCompressor return the compressor of the requests of the call
+func requestCompressor(ctx context.Context) string {
+	if name, ok := ctx.Value(compressorKey{}).(*string); ok {
+		return *name
+	}
+	return common.CompressorIdentity
+}
+
+// CompressorUnaryServerInterceptor echo the compressor of the request in the response
+func CompressorUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if r, ok := resp.(*grpctest.Response); ok {
+			r.Compressor = requestCompressor(ctx)
+		}
+		return resp, err
+	}
+}
+
+// CompressorStreamServerInterceptor echo the compressor of the requests in every response
+func CompressorStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &compressorStream{ServerStream: ss, compressor: requestCompressor(ss.Context())})
+	}
+}
+
+type compressorStream struct {
+	grpc.ServerStream
+	compressor string
+}
+
+func (s *compressorStream) SendMsg(m interface{}) error {
+	if r, ok := m.(*grpctest.Response); ok {
+		r.Compressor = s.compressor
+	}
+	return s.ServerStream.SendMsg(m)
+}
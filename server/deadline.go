@@ -0,0 +1,148 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	grpctest "github.com/bclermont/grpctest/proto"
+)
+
+// Deadline modes
+const (
+	// deadlineHonor fail the calls with DEADLINE_EXCEEDED as soon as their deadline is reached
+	deadlineHonor = "honor"
+	// deadlineExceed hold the responses until the deadline is past by the overrun, as a slow server would
+	deadlineExceed = "exceed"
+
+	// mdDeadlineMode replace the deadline mode of the server for one call
+	mdDeadlineMode = "x-grpctest-deadline-mode"
+)
+
+// checkDeadlineMode return an error if mode isn't a deadline mode
+func checkDeadlineMode(mode string) error {
+	if mode != deadlineHonor && mode != deadlineExceed {
+		return errors.Errorf("Unknown deadline mode %q, expected %s or %s", mode, deadlineHonor, deadlineExceed)
+	}
+	return nil
+}
+
+// callDeadline is the deadline of a call as received by the server
+type callDeadline struct {
+	mode     string
+	overrun  time.Duration
+	deadline time.Time
+	// remaining is the time left when the call was received, 0 without deadline
+	remaining time.Duration
+	log       *zap.Logger
+}
+
+// newCallDeadline read the deadline of the call and the mode requested in its metadata
+func newCallDeadline(ctx context.Context, mode string, overrun time.Duration, log *zap.Logger) (*callDeadline, error) {
+	d := &callDeadline{mode: mode, overrun: overrun, log: log}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md[mdDeadlineMode]; len(values) > 0 {
+			if err := checkDeadlineMode(values[0]); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid %s: %v", mdDeadlineMode, err)
+			}
+			d.mode = values[0]
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		d.deadline = deadline
+		if d.remaining = time.Until(deadline); d.remaining <= 0 {
+			// gRPC set a minimal timeout, the call expired on its way
+			d.remaining = time.Nanosecond
+		}
+	}
+	return d, nil
+}
+
+// check return DEADLINE_EXCEEDED if the deadline is honored and reached. The time is compared rather
+// than the context error, it's canceled when the client give up first.
+func (d *callDeadline) check() error {
+	if d.mode != deadlineHonor || d.deadline.IsZero() || time.Now().Before(d.deadline) {
+		return nil
+	}
+	d.log.Info("Deadline reached, stop the call", zap.Duration("remaining_at_start", d.remaining))
+	return status.Error(codes.DeadlineExceeded, "Deadline exceeded")
+}
+
+// exceed wait until the deadline is past by the overrun in exceed mode, whatever the client does
+func (d *callDeadline) exceed() {
+	if d.mode != deadlineExceed || d.deadline.IsZero() {
+		return
+	}
+	if wait := time.Until(d.deadline.Add(d.overrun)); wait > 0 {
+		time.Sleep(wait)
+	}
+	d.log.Info("Answer after the deadline", zap.Duration("remaining_at_start", d.remaining), zap.Duration("overrun", d.overrun))
+}
+
+// set report the remaining deadline in the response
+func (d *callDeadline) set(m interface{}) {
+	if r, ok := m.(*grpctest.Response); ok {
+		r.DeadlineRemaining = int64(d.remaining)
+	}
+}
+
+// DeadlineUnaryServerInterceptor report the remaining deadline in the response, and honor or exceed the deadline
+func DeadlineUnaryServerInterceptor(mode string, overrun time.Duration, log *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		d, err := newCallDeadline(ctx, mode, overrun, log.With(zap.String("method", info.FullMethod)))
+		if err != nil {
+			return nil, err
+		}
+		if err = d.check(); err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		if honored := d.check(); honored != nil {
+			return nil, honored
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.exceed()
+		d.set(resp)
+		return resp, nil
+	}
+}
+
+// DeadlineStreamServerInterceptor report the remaining deadline in every response, and honor or exceed the deadline
+func DeadlineStreamServerInterceptor(mode string, overrun time.Duration, log *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		d, err := newCallDeadline(ss.Context(), mode, overrun, log.With(zap.String("method", info.FullMethod)))
+		if err != nil {
+			return err
+		}
+		if err = d.check(); err != nil {
+			return err
+		}
+		err = handler(srv, &deadlineStream{ServerStream: ss, deadline: d})
+		if honored := d.check(); honored != nil {
+			return honored
+		}
+		return err
+	}
+}
+
+type deadlineStream struct {
+	grpc.ServerStream
+	deadline *callDeadline
+}
+
+func (s *deadlineStream) SendMsg(m interface{}) error {
+	if err := s.deadline.check(); err != nil {
+		return err
+	}
+	s.deadline.exceed()
+	s.deadline.set(m)
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+// Metadata headers controlling the faults injected in a call
+const (
+	mdFailCode          = "x-grpctest-fail-code"
+	mdFailAfterMessages = "x-grpctest-fail-after-messages"
+	mdDelay             = "x-grpctest-delay"
+	mdAbortAfter        = "x-grpctest-abort-after"
+
+	// defaultFaultCode is used when a fault point is set without a code
+	defaultFaultCode = codes.Aborted
+)
+
+// faults requested by a client for one call
+type faults struct {
+	code codes.Code
+	// failNow is set when a code is requested without any fault point
+	failNow bool
+	// failAfterMessages is the number of messages sent or received before failing, -1 to disable
+	failAfterMessages int64
+	delay             time.Duration
+	abortAfter        time.Duration
+}
+
+// faultsFromContext read the fault headers of the call, nil if there is none
+func faultsFromContext(ctx context.Context) (*faults, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	get := func(key string) string {
+		if values := md[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	f := &faults{code: defaultFaultCode, failAfterMessages: -1}
+	found := false
+	if val := get(mdFailCode); len(val) > 0 {
+		code, err := common.ParseCode(val)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s: %v", mdFailCode, err)
+		}
+		f.code, f.failNow, found = code, true, true
+	}
+	if val := get(mdFailAfterMessages); len(val) > 0 {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || n < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s: %q", mdFailAfterMessages, val)
+		}
+		f.failAfterMessages, f.failNow, found = n, false, true
+	}
+	if val := get(mdDelay); len(val) > 0 {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s: %v", mdDelay, err)
+		}
+		f.delay, found = d, true
+	}
+	if val := get(mdAbortAfter); len(val) > 0 {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s: %v", mdAbortAfter, err)
+		}
+		f.abortAfter, f.failNow, found = d, false, true
+	}
+	if !found {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f *faults) zapFields() []zap.Field {
+	return []zap.Field{
+		common.GrpcCodeField(f.code),
+		zap.Int64("fail_after_messages", f.failAfterMessages),
+		zap.Duration("delay", f.delay),
+		zap.Duration("abort_after", f.abortAfter),
+	}
+}
+
+// wait apply the requested delay, unless the call is done first
+func (f *faults) wait(ctx context.Context) error {
+	if f.delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(f.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FaultUnaryServerInterceptor inject the faults requested in the call metadata
+func FaultUnaryServerInterceptor(log *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		f, err := faultsFromContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			return handler(ctx, req)
+		}
+		fLog := log.With(zap.String("method", info.FullMethod))
+		fLog.Debug("Faults requested", f.zapFields()...)
+		call := func(ctx context.Context) (interface{}, error) {
+			if err := f.wait(ctx); err != nil {
+				return nil, err
+			}
+			if f.failNow || f.failAfterMessages == 0 {
+				err := status.Error(f.code, "Injected failure")
+				fLog.Info("Injected failure", common.GrpcErrorFields(err)...)
+				return nil, err
+			}
+			return handler(ctx, req)
+		}
+		if f.abortAfter <= 0 {
+			return call(ctx)
+		}
+
+		// the abort is counted from the start of the call, a delay longer than it is aborted too
+		ctx, cancelFn := context.WithCancel(ctx)
+		defer cancelFn()
+		abort := time.NewTimer(f.abortAfter)
+		defer abort.Stop()
+		type result struct {
+			resp interface{}
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			resp, err := call(ctx)
+			done <- result{resp: resp, err: err}
+		}()
+		select {
+		case r := <-done:
+			return r.resp, r.err
+		case <-abort.C:
+			err = status.Error(f.code, "Injected abort")
+			fLog.Info("Injected abort", common.GrpcErrorFields(err)...)
+			return nil, err
+		}
+	}
+}
+
+// FaultStreamServerInterceptor inject the faults requested in the stream metadata
+func FaultStreamServerInterceptor(log *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		f, err := faultsFromContext(ctx)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return handler(srv, ss)
+		}
+		fLog := log.With(zap.String("method", info.FullMethod))
+		fLog.Debug("Faults requested", f.zapFields()...)
+		if err = f.wait(ctx); err != nil {
+			return err
+		}
+		if f.failNow || f.failAfterMessages == 0 {
+			err = status.Error(f.code, "Injected failure")
+			fLog.Info("Injected failure", common.GrpcErrorFields(err)...)
+			return err
+		}
+
+		ctx, cancelFn := context.WithCancel(ctx)
+		defer cancelFn()
+		fs := &faultStream{ServerStream: ss, ctx: ctx, faults: f}
+		if f.abortAfter > 0 {
+			timer := time.AfterFunc(f.abortAfter, func() {
+				fs.inject(status.Error(f.code, "Injected abort"))
+				cancelFn()
+			})
+			defer timer.Stop()
+		}
+
+		err = handler(srv, fs)
+		if injected := fs.injected(); injected != nil {
+			fLog.Info("Injected stream failure", append(common.GrpcErrorFields(injected), zap.Int64("messages", atomic.LoadInt64(&fs.messages)))...)
+			return injected
+		}
+		return err
+	}
+}
+
+// faultStream count messages and fail once the requested number is reached
+type faultStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	faults   *faults
+	messages int64
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *faultStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *faultStream) inject(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *faultStream) injected() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// count a message and return the injected error if the stream must fail
+func (s *faultStream) count() error {
+	if err := s.injected(); err != nil {
+		return err
+	}
+	n := atomic.AddInt64(&s.messages, 1)
+	if s.faults.failAfterMessages >= 0 && n > s.faults.failAfterMessages {
+		s.inject(status.Error(s.faults.code, "Injected failure after messages"))
+		return s.injected()
+	}
+	return nil
+}
+
+func (s *faultStream) SendMsg(m interface{}) error {
+	if err := s.count(); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *faultStream) RecvMsg(m interface{}) error {
+	if err := s.injected(); err != nil {
+		return err
+	}
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.count()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestFaultUnaryServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name string
+		md   metadata.MD
+		// handling is how long the handler take, it stop early if its context is done
+		handling time.Duration
+		want     codes.Code
+	}{
+		{name: "without faults", want: codes.OK},
+		{name: "fail code", md: metadata.Pairs(mdFailCode, "UNAVAILABLE"), want: codes.Unavailable},
+		{name: "fail after no message", md: metadata.Pairs(mdFailAfterMessages, "0"), want: defaultFaultCode},
+		{name: "delay", md: metadata.Pairs(mdDelay, "10ms"), want: codes.OK},
+		{name: "invalid delay", md: metadata.Pairs(mdDelay, "soon"), want: codes.InvalidArgument},
+		{name: "invalid abort", md: metadata.Pairs(mdAbortAfter, "soon"), want: codes.InvalidArgument},
+		{
+			name:     "abort a slow handler",
+			md:       metadata.Pairs(mdAbortAfter, "10ms"),
+			handling: time.Second,
+			want:     defaultFaultCode,
+		},
+		{
+			name: "abort during the delay",
+			md:   metadata.Pairs(mdAbortAfter, "10ms", mdDelay, "1s", mdFailCode, "UNAVAILABLE"),
+			want: codes.Unavailable,
+		},
+		{
+			name:     "answer before the abort",
+			md:       metadata.Pairs(mdAbortAfter, "1s"),
+			handling: time.Millisecond,
+			want:     codes.OK,
+		},
+	}
+	interceptor := FaultUnaryServerInterceptor(zap.NewNop())
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpctest.GrpcTest/Unary"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				select {
+				case <-time.After(tt.handling):
+					return req, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			start := time.Now()
+			resp, err := interceptor(ctx, "request", info, handler)
+			if got := status.Code(err); got != tt.want {
+				t.Fatalf("interceptor() code %s, want %s: %v", got, tt.want, err)
+			}
+			if err == nil && resp != "request" {
+				t.Errorf("interceptor() = %v, want the handler response", resp)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("interceptor() took %s, the abort wasn't injected in time", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthServer is the standard health service with a serving status per service that can be changed at runtime.
+// It doesn't require authentication, so load balancers and orchestrators can probe the server.
+type healthServer struct {
+	*health.Server
+	log *zap.Logger
+	// stopped is closed on shutdown, after every service is set not serving
+	stopped chan struct{}
+
+	mu       sync.Mutex
+	statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+}
+
+// newHealthServer create a health service where the server, as the empty service name, and services are serving
+func newHealthServer(log *zap.Logger, services ...string) *healthServer {
+	h := &healthServer{
+		Server:   health.NewServer(),
+		log:      log,
+		stopped:  make(chan struct{}),
+		statuses: make(map[string]healthpb.HealthCheckResponse_ServingStatus),
+	}
+	for _, service := range append([]string{""}, services...) {
+		h.set(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	return h
+}
+
+// AuthFuncOverride let health checks in without credentials
+func (h *healthServer) AuthFuncOverride(ctx context.Context, _ string) (context.Context, error) {
+	return ctx, nil
+}
+
+// Watch send the serving status of a service when it change, until the client cancel or the server shut down
+func (h *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx, cancelFn := context.WithCancel(stream.Context())
+	defer cancelFn()
+	go func() {
+		select {
+		case <-h.stopped:
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+	err := h.Server.Watch(req, watchStream{stream, ctx})
+	select {
+	case <-h.stopped:
+		return nil
+	default:
+		return err
+	}
+}
+
+// watchStream replace the context of a stream
+type watchStream struct {
+	healthpb.Health_WatchServer
+	ctx context.Context
+}
+
+func (s watchStream) Context() context.Context {
+	return s.ctx
+}
+
+// set change the serving status of service, the watchers are notified
+func (h *healthServer) set(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if previous, ok := h.statuses[service]; ok && previous != status {
+		h.log.Info("Health status changed", zap.String("service", service), zap.Stringer("status", status), zap.Stringer("previous", previous))
+	}
+	h.statuses[service] = status
+	h.SetServingStatus(service, status)
+}
+
+// setAll change the serving status of every known service
+func (h *healthServer) setAll(status healthpb.HealthCheckResponse_ServingStatus) {
+	for _, service := range h.services() {
+		h.set(service, status)
+	}
+}
+
+// get return the serving status of every known service
+func (h *healthServer) get() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	statuses := make(map[string]string, len(h.statuses))
+	for service, status := range h.statuses {
+		statuses[service] = status.String()
+	}
+	return statuses
+}
+
+// services return the known service names, sorted
+func (h *healthServer) services() []string {
+	statuses := h.get()
+	services := make([]string, 0, len(statuses))
+	for service := range statuses {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// watch toggle every service between serving and not serving on SIGUSR1, and set them not serving on shutdown
+func (h *healthServer) watch(shutdown <-chan struct{}) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for {
+			select {
+			case <-usr1:
+				status := healthpb.HealthCheckResponse_NOT_SERVING
+				h.mu.Lock()
+				if h.statuses[""] != healthpb.HealthCheckResponse_SERVING {
+					status = healthpb.HealthCheckResponse_SERVING
+				}
+				h.mu.Unlock()
+				h.setAll(status)
+			case <-shutdown:
+				signal.Stop(usr1)
+				h.setAll(healthpb.HealthCheckResponse_NOT_SERVING)
+				close(h.stopped)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+// Instance states
+const (
+	instanceServing  = "serving"
+	instancePaused   = "paused"
+	instanceDraining = "draining"
+	instanceStopped  = "stopped"
+)
+
+// buildFunc create the gRPC server of an instance, its streams end when shutdown is closed
+type buildFunc func(i *instance, shutdown <-chan struct{}) (*grpc.Server, *healthServer)
+
+// instance is a gRPC server listening on its own port, it can be paused, drained, killed and started
+// again while the other instances of the process keep serving
+type instance struct {
+	id    string
+	addr  string
+	build buildFunc
+	conns *connTracker
+	log   *zap.Logger
+
+	mu         sync.Mutex
+	state      string
+	grpcServer *grpc.Server
+	health     *healthServer
+	// shutdown is closed when the instance is drained or killed
+	shutdown chan struct{}
+	// resumed is closed unless the instance is paused
+	resumed chan struct{}
+}
+
+// newInstances create n stopped instances, the first one listen on addr and the next ones on the
+// following ports, or on the unix socket of addr suffixed by their ID
+func newInstances(n int, addr string, build buildFunc, conns *connTracker, log *zap.Logger) ([]*instance, error) {
+	var (
+		host string
+		port int
+	)
+	if !common.IsUnixAddress(addr) {
+		h, p, err := net.SplitHostPort(addr)
+		if err == nil {
+			host = h
+			port, err = strconv.Atoi(p)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid listen address %q", addr)
+		}
+	}
+	instances := make([]*instance, n)
+	for i := range instances {
+		id := strconv.Itoa(i)
+		instanceAddr := addr
+		switch {
+		case i == 0:
+		case common.IsUnixAddress(addr):
+			instanceAddr = addr + "-" + id
+		default:
+			instanceAddr = net.JoinHostPort(host, strconv.Itoa(port+i))
+		}
+		instances[i] = &instance{
+			id:    id,
+			addr:  instanceAddr,
+			build: build,
+			conns: conns,
+			log:   log.With(zap.String("instance", id)),
+			state: instanceStopped,
+		}
+	}
+	return instances, nil
+}
+
+// findInstance return the instance with id
+func findInstance(instances []*instance, id string) (*instance, bool) {
+	for _, i := range instances {
+		if i.id == id {
+			return i, true
+		}
+	}
+	return nil, false
+}
+
+// start listen and serve, the instance must be stopped
+func (i *instance) start() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.state != instanceStopped {
+		return errors.Errorf("Instance %s is %s", i.id, i.state)
+	}
+	lis, err := common.Listen(i.addr)
+	if err != nil {
+		return errors.Wrapf(err, "Can't bind %s", i.addr)
+	}
+	i.shutdown = make(chan struct{})
+	i.resumed = make(chan struct{})
+	close(i.resumed)
+	i.grpcServer, i.health = i.build(i, i.shutdown)
+	i.state = instanceServing
+
+	go func(grpcServer *grpc.Server, lis net.Listener) {
+		if err := grpcServer.Serve(lis); err != nil && err != grpc.ErrServerStopped {
+			i.failed(grpcServer, err)
+		}
+	}(i.grpcServer, newTrackingListener(lis, i.conns))
+	i.log.Info("Listen gRPC Server", zap.String("address", lis.Addr().String()))
+	return nil
+}
+
+// failed stop the instance when its gRPC server can't serve, the other instances keep serving
+func (i *instance) failed(grpcServer *grpc.Server, err error) {
+	i.mu.Lock()
+	if i.grpcServer != grpcServer || i.state == instanceStopped {
+		// killed or started again meanwhile
+		i.mu.Unlock()
+		return
+	}
+	if i.state != instanceDraining {
+		close(i.shutdown)
+	}
+	i.state = instanceStopped
+	i.mu.Unlock()
+
+	grpcServer.Stop()
+	i.log.Error("Can't grpc serve, instance stopped", zap.Error(err))
+}
+
+// pause hold the calls and the stream messages until resume
+func (i *instance) pause() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.state != instanceServing {
+		return errors.Errorf("Instance %s is %s", i.id, i.state)
+	}
+	i.state = instancePaused
+	i.resumed = make(chan struct{})
+	i.log.Info("Instance paused")
+	return nil
+}
+
+func (i *instance) resume() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.state != instancePaused {
+		return errors.Errorf("Instance %s is %s", i.id, i.state)
+	}
+	i.state = instanceServing
+	close(i.resumed)
+	i.log.Info("Instance resumed")
+	return nil
+}
+
+// drain end the streams, set every service not serving and stop gracefully. The returned channel
+// is closed when the running calls ended.
+func (i *instance) drain() (<-chan struct{}, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.state == instanceDraining || i.state == instanceStopped {
+		return nil, errors.Errorf("Instance %s is %s", i.id, i.state)
+	}
+	i.state = instanceDraining
+	close(i.shutdown)
+	i.log.Info("Draining instance")
+
+	drained := make(chan struct{})
+	go func(grpcServer *grpc.Server) {
+		grpcServer.GracefulStop()
+		i.mu.Lock()
+		if i.state == instanceDraining {
+			i.state = instanceStopped
+			i.log.Info("Instance stopped")
+		}
+		i.mu.Unlock()
+		close(drained)
+	}(i.grpcServer)
+	return drained, nil
+}
+
+// drainWithin drain the instance and kill it if calls are still running after timeout
+func (i *instance) drainWithin(timeout time.Duration) error {
+	drained, err := i.drain()
+	if err != nil {
+		return err
+	}
+	go func() {
+		select {
+		case <-drained:
+		case <-time.After(timeout):
+			i.log.Warn("Calls still running after shutdown timeout, cancel them")
+			i.kill()
+		}
+	}()
+	return nil
+}
+
+// kill close the listener and every connection abruptly, running calls are cancelled
+func (i *instance) kill() error {
+	i.mu.Lock()
+	if i.state == instanceStopped {
+		i.mu.Unlock()
+		return errors.Errorf("Instance %s is %s", i.id, i.state)
+	}
+	if i.state != instanceDraining {
+		close(i.shutdown)
+	}
+	i.state = instanceStopped
+	grpcServer := i.grpcServer
+	i.mu.Unlock()
+
+	grpcServer.Stop()
+	i.log.Info("Instance killed")
+	return nil
+}
+
+// healthServer return the health service of the running instance, nil if it's stopped
+func (i *instance) healthServer() *healthServer {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.state == instanceStopped {
+		return nil
+	}
+	return i.health
+}
+
+// instanceStatus describe an instance in the admin API
+type instanceStatus struct {
+	ID      string `yaml:"id"`
+	Address string `yaml:"address"`
+	State   string `yaml:"state"`
+}
+
+func (i *instance) status() instanceStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return instanceStatus{ID: i.id, Address: i.addr, State: i.state}
+}
+
+// wait block while the instance is paused
+func (i *instance) wait(ctx context.Context) error {
+	i.mu.Lock()
+	resumed, shutdown := i.resumed, i.shutdown
+	i.mu.Unlock()
+	select {
+	case <-resumed:
+	case <-shutdown:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// UnaryServerInterceptor hold the calls while the instance is paused
+func (i *instance) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := i.wait(ctx); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor hold the messages of the streams while the instance is paused
+func (i *instance) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := i.wait(ss.Context()); err != nil {
+			return err
+		}
+		return handler(srv, &pausedStream{ServerStream: ss, instance: i})
+	}
+}
+
+type pausedStream struct {
+	grpc.ServerStream
+	instance *instance
+}
+
+func (s *pausedStream) SendMsg(m interface{}) error {
+	if err := s.instance.wait(s.Context()); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *pausedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.instance.wait(s.Context())
+}
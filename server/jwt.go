@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/bclermont/grpctest/proto"
+)
+
+// jwtValidator accept HS256 tokens signed with a shared secret and RS256/ES256/ES384/ES512 tokens signed by a key of a JWKS
+type jwtValidator struct {
+	secret   []byte
+	jwks     *jose.JSONWebKeySet
+	audience string
+}
+
+func newJWTValidator(secret, jwksFile, audience string) (*jwtValidator, error) {
+	v := &jwtValidator{audience: audience}
+	if len(secret) > 0 {
+		v.secret = []byte(secret)
+	}
+	if len(jwksFile) > 0 {
+		data, err := ioutil.ReadFile(jwksFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Can't read JWKS file")
+		}
+		v.jwks = &jose.JSONWebKeySet{}
+		if err = json.Unmarshal(data, v.jwks); err != nil {
+			return nil, errors.Wrapf(err, "Can't parse JWKS file %q", jwksFile)
+		}
+	}
+	if v.secret == nil && v.jwks == nil {
+		return nil, errors.New("JWT authentication needs a secret or a JWKS file")
+	}
+	return v, nil
+}
+
+// verificationKey return the key matching the token algorithm and key ID
+func (v *jwtValidator) verificationKey(header jose.Header) (interface{}, error) {
+	alg := jose.SignatureAlgorithm(header.Algorithm)
+	switch alg {
+	case jose.HS256:
+		if v.secret == nil {
+			break
+		}
+		return v.secret, nil
+	case jose.RS256, jose.ES256, jose.ES384, jose.ES512:
+		if v.jwks == nil {
+			break
+		}
+		for _, k := range v.jwks.Keys {
+			if (len(header.KeyID) == 0 || k.KeyID == header.KeyID) && (len(k.Algorithm) == 0 || k.Algorithm == header.Algorithm) {
+				return k.Key, nil
+			}
+		}
+		return nil, errors.Errorf("Unknown key %q", header.KeyID)
+	}
+	return nil, errors.Errorf("Algorithm %q not accepted", alg)
+}
+
+func (v *jwtValidator) validate(token string) (*jwt.Claims, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("Token must have exactly one signature")
+	}
+	key, err := v.verificationKey(tok.Headers[0])
+	if err != nil {
+		return nil, err
+	}
+	claims := &jwt.Claims{}
+	if err = tok.Claims(key, claims); err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("Missing exp claim")
+	}
+	if err = claims.Validate(jwt.Expected{Time: time.Now()}); err != nil {
+		return nil, err
+	}
+	if len(v.audience) > 0 && !claims.Audience.Contains(v.audience) {
+		return nil, jwt.ErrInvalidAudience
+	}
+	return claims, nil
+}
+
+// authenticate check the bearer JWT of the call and log its subject
+func (v *jwtValidator) authenticate(ctx context.Context) (context.Context, error) {
+	val, err := grpc_auth.AuthFromMD(ctx, grpctest.Scheme)
+	if err != nil {
+		return ctx, err
+	}
+	claims, err := v.validate(val)
+	if err != nil {
+		return ctx, grpc.Errorf(codes.Unauthenticated, "Invalid token: %v", err)
+	}
+	ctxzap.AddFields(ctx, zap.String("auth.sub", claims.Subject))
+	return ctx, nil
+}
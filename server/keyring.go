@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/bclermont/grpctest/common"
+	"github.com/bclermont/grpctest/proto"
+)
+
+// keysReloadDelay is how long the keys file must stay unchanged before it's reloaded
+const keysReloadDelay = time.Millisecond * 200
+
+// keyGeneration is the set of keys accepted at some point, with the previous set kept for a grace period
+type keyGeneration struct {
+	current       *keyStore
+	previous      *keyStore
+	previousUntil time.Time
+}
+
+// keyRing swap the accepted API keys atomically when they are reloaded.
+// Reload only affect new calls, streams already authenticated are left open.
+type keyRing struct {
+	load  func() (*keyStore, error)
+	grace time.Duration
+	log   *zap.Logger
+
+	mu         sync.Mutex // serialize reloads
+	generation atomic.Value
+}
+
+func newKeyRing(load func() (*keyStore, error), grace time.Duration, log *zap.Logger) (*keyRing, error) {
+	keys, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r := &keyRing{load: load, grace: grace, log: log}
+	r.generation.Store(&keyGeneration{current: keys})
+	return r, nil
+}
+
+// reload replace the current keys, previous ones are still accepted during the grace period
+func (r *keyRing) reload() error {
+	keys, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.generation.Load().(*keyGeneration)
+	if reflect.DeepEqual(old.current, keys) {
+		// keep the previous keys of the last real change
+		r.log.Debug("API keys unchanged")
+		return nil
+	}
+	r.generation.Store(&keyGeneration{
+		current:       keys,
+		previous:      old.current,
+		previousUntil: time.Now().Add(r.grace),
+	})
+	r.log.Info("Reloaded API keys", zap.Int("count", len(keys.keys)), zap.Duration("grace", r.grace))
+	return nil
+}
+
+// authenticate check the bearer token of the call against the current keys, then the previous ones
+func (r *keyRing) authenticate(ctx context.Context) (context.Context, error) {
+	val, err := grpc_auth.AuthFromMD(ctx, grpctest.Scheme)
+	if err != nil {
+		return ctx, err
+	}
+	gen := r.generation.Load().(*keyGeneration)
+	k := gen.current.lookup(val)
+	if k == nil && gen.previous != nil && time.Now().Before(gen.previousUntil) {
+		k = gen.previous.lookup(val)
+	}
+	if k == nil {
+		return ctx, grpc.Errorf(codes.Unauthenticated, "Invalid API key")
+	}
+	return authorize(ctx, k)
+}
+
+// watch reload the keys on SIGHUP and, if keysFile isn't empty, whenever the file change
+func (r *keyRing) watch(keysFile string) {
+	reload := func(reason string) {
+		if err := r.reload(); err != nil {
+			r.log.Error("Can't reload API keys, keep the current ones", zap.Error(err), zap.String("reason", reason))
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload("SIGHUP")
+		}
+	}()
+
+	if len(keysFile) == 0 {
+		return
+	}
+	if err := common.WatchFile(keysFile, keysReloadDelay, func() { reload("file changed") }, r.log); err != nil {
+		r.log.Error("Can't watch API keys file", zap.Error(err))
+	}
+}
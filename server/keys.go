@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/yaml.v2"
+
+	"github.com/bclermont/grpctest/common"
+)
+
+const defaultKeyName = "default"
+
+// apiKey is a secret accepted by the server, restricted to some methods until it expires
+type apiKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// Methods is the list of full method names allowed for this key, all methods are allowed when empty
+	Methods []string  `yaml:"methods"`
+	Expires time.Time `yaml:"expires"`
+}
+
+func (k *apiKey) allowed(method string) bool {
+	if len(k.Methods) == 0 {
+		return true
+	}
+	for _, m := range k.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// keyStore is the immutable set of accepted API keys
+type keyStore struct {
+	keys []*apiKey
+}
+
+type keyFile struct {
+	Keys []*apiKey `yaml:"keys"`
+}
+
+// loadKeyStore read the API keys from a YAML file
+func loadKeyStore(path string) (*keyStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read keys file")
+	}
+	var f keyFile
+	if err = yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, errors.Wrapf(err, "Can't parse keys file %q", path)
+	}
+	names := make(map[string]bool, len(f.Keys))
+	for i, k := range f.Keys {
+		if len(k.Name) == 0 || len(k.Key) == 0 {
+			return nil, errors.Errorf("Key #%d in %q must have a name and a key", i, path)
+		}
+		if names[k.Name] {
+			return nil, errors.Errorf("Duplicated key name %q in %q", k.Name, path)
+		}
+		names[k.Name] = true
+	}
+	return &keyStore{keys: f.Keys}, nil
+}
+
+// singleKeyStore accept only one key, for all methods
+func singleKeyStore(key string) *keyStore {
+	return &keyStore{keys: []*apiKey{{Name: defaultKeyName, Key: key}}}
+}
+
+func (ks *keyStore) lookup(secret string) *apiKey {
+	for _, k := range ks.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(secret)) == 1 {
+			return k
+		}
+	}
+	return nil
+}
+
+// loadKeys read the API keys from the keys file if one is configured, else from the KEY environment variable
+func loadKeys() (*keyStore, error) {
+	if keysFile := common.KeysFile(); len(keysFile) > 0 {
+		return loadKeyStore(keysFile)
+	}
+	return singleKeyStore(common.APIKey()), nil
+}
+
+// authorize check that a key can call the method of the call
+func authorize(ctx context.Context, k *apiKey) (context.Context, error) {
+	ctxzap.AddFields(ctx, zap.String("auth.key", k.Name))
+	if !k.Expires.IsZero() && time.Now().After(k.Expires) {
+		return ctx, grpc.Errorf(codes.Unauthenticated, "API key expired")
+	}
+	method, _ := grpc.Method(ctx)
+	if !k.allowed(method) {
+		return ctx, grpc.Errorf(codes.PermissionDenied, "API key %q isn't allowed to call %s", k.Name, method)
+	}
+	return ctx, nil
+}
@@ -1,63 +1,104 @@
 package main
 
 import (
-	"fmt"
-	"net"
+	"net/http"
 	"time"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"github.com/grpc-ecosystem/go-grpc-middleware/recovery"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
-	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
 
 	"github.com/bclermont/grpctest/common"
 	"github.com/bclermont/grpctest/proto"
 )
 
+const (
+	keyAdmin        = "admin"
+	keyChaosProfile = "chaos_profile"
+	// keyMaxConnectionAge make the server send GOAWAY to connections older than this, with a random jitter
+	keyMaxConnectionAge = "max_connection_age"
+	// keyShutdownTimeout bound the time running calls have to end after SIGINT or SIGTERM
+	keyShutdownTimeout = "shutdown_timeout"
+	// keyInstances is the number of server instances, listening on consecutive ports
+	keyInstances = "instances"
+	// keyDeadlineMode is honor to stop the calls at their deadline, or exceed to answer after it
+	keyDeadlineMode = "deadline_mode"
+	// keyDeadlineOverrun is how long after the deadline the responses are sent in exceed mode
+	keyDeadlineOverrun = "deadline_overrun"
+)
+
+func init() {
+	viper.SetDefault(keyShutdownTimeout, time.Second*30)
+	viper.SetDefault(keyInstances, 1)
+	viper.SetDefault(keyDeadlineMode, deadlineHonor)
+	viper.SetDefault(keyDeadlineOverrun, time.Millisecond*100)
+}
+
 func main() {
-	port, apiKey, interval, log := common.Init()
+	port, _, interval, log := common.Init()
+	if viper.GetInt(keyInstances) < 1 {
+		log.Fatal("Invalid number of instances", zap.Int("instances", viper.GetInt(keyInstances)))
+	}
+	deadlineMode, deadlineOverrun := viper.GetString(keyDeadlineMode), viper.GetDuration(keyDeadlineOverrun)
+	if err := checkDeadlineMode(deadlineMode); err != nil {
+		log.Fatal("Can't configure deadlines", zap.Error(err))
+	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	var (
+		profile *chaosProfile
+		err     error
+	)
+	if profileFile := viper.GetString(keyChaosProfile); len(profileFile) > 0 {
+		if profile, err = loadChaosProfile(profileFile); err != nil {
+			log.Fatal("Can't load chaos profile", zap.Error(err))
+		}
+		log.Info("Chaos enabled", zap.String("file", profileFile))
+	}
+	creds, err := common.ServerCredentials()
 	if err != nil {
-		log.Fatal("Can't bind port", zap.Error(err), zap.Int("port", port))
+		log.Fatal("Can't load TLS configuration", zap.Error(err))
 	}
+	conns := newConnTracker(creds != nil)
+	chaosMonkey := newChaos(profile, conns, log)
 
-	myAuthFunction := func(ctx context.Context) (context.Context, error) {
-		val, err := grpc_auth.AuthFromMD(ctx, grpctest.Scheme)
+	admin := http.NewServeMux()
+	admin.Handle("/chaos", chaosHandler(chaosMonkey))
+
+	var authenticate grpc_auth.AuthFunc
+	switch mode := common.AuthMode(); mode {
+	case common.AuthModeKey:
+		keys, err := newKeyRing(loadKeys, common.KeysGrace(), log)
 		if err != nil {
-			return ctx, err
+			log.Fatal("Can't load API keys", zap.Error(err))
 		}
-		if val != apiKey {
-			return ctx, grpc.Errorf(codes.Unauthenticated, "Invalid API key")
+		keys.watch(common.KeysFile())
+		authenticate = keys.authenticate
+	case common.AuthModeJWT:
+		cfg := common.LoadJWTConfig()
+		validator, err := newJWTValidator(cfg.Secret, cfg.JWKSFile, cfg.Audience)
+		if err != nil {
+			log.Fatal("Can't configure JWT authentication", zap.Error(err))
 		}
-		return ctx, nil
+		authenticate = validator.authenticate
+	default:
+		log.Fatal("Unknown authentication mode", zap.String("mode", mode))
 	}
 
-	grpc_zap.ReplaceGrpcLogger(log)
-	grpcServer := grpc.NewServer(
-		grpc.StreamInterceptor(
-			grpc_middleware.ChainStreamServer(
-				grpc_zap.StreamServerInterceptor(log),
-				grpc_auth.StreamServerInterceptor(myAuthFunction),
-				grpc_recovery.StreamServerInterceptor(),
-			),
-		),
-		grpc.UnaryInterceptor(
-			grpc_middleware.ChainUnaryServer(
-				grpc_zap.UnaryServerInterceptor(log),
-				grpc_auth.UnaryServerInterceptor(myAuthFunction),
-				grpc_recovery.UnaryServerInterceptor(),
-			),
-		),
+	options := []grpc.ServerOption{
+		grpc.StatsHandler(compressionHandler{}),
 		grpc.KeepaliveParams(
 			keepalive.ServerParameters{
-				Time:    common.IdlePing,
-				Timeout: common.IdlePingTimeout,
+				Time:             common.IdlePing,
+				Timeout:          common.IdlePingTimeout,
+				MaxConnectionAge: viper.GetDuration(keyMaxConnectionAge),
 			},
 		),
 		grpc.KeepaliveEnforcementPolicy(
@@ -66,14 +107,88 @@ func main() {
 				PermitWithoutStream: true,
 			},
 		),
-	)
+	}
+	if creds != nil {
+		log.Info("TLS enabled")
+		options = append(options, grpc.Creds(&chaosCredentials{TransportCredentials: creds, conns: conns}))
+	}
 
-	grpctest.RegisterGrpcTestServer(grpcServer, &server{
-		log:      log,
-		interval: interval,
-	})
-	log.Info("Listen gRPC Server", zap.String("address", lis.Addr().String()))
-	if err = grpcServer.Serve(lis); err != nil {
-		log.Fatal("Can't grpc serve", zap.Error(err))
+	payloads, err := common.LoadPayloadGenerator()
+	if err != nil {
+		log.Fatal("Can't configure payloads", zap.Error(err))
+	}
+	maxMessageSize, err := common.MaxMessageSize()
+	if err != nil {
+		log.Fatal("Can't configure maximum message size", zap.Error(err))
 	}
+	if maxMessageSize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(maxMessageSize), grpc.MaxSendMsgSize(maxMessageSize))
+	}
+
+	grpc_zap.ReplaceGrpcLogger(log)
+	grpc_prometheus.EnableHandlingTimeHistogram()
+	// the instances share the sessions, so a client balanced between them see a single sequence
+	sessions := common.NewSequenceSessions()
+	build := func(i *instance, shutdown <-chan struct{}) (*grpc.Server, *healthServer) {
+		log := i.log
+		grpcServer := grpc.NewServer(append([]grpc.ServerOption{
+			grpc.StreamInterceptor(
+				grpc_middleware.ChainStreamServer(
+					grpc_prometheus.StreamServerInterceptor,
+					common.ActiveStreamServerInterceptor(),
+					grpc_zap.StreamServerInterceptor(log),
+					DeadlineStreamServerInterceptor(deadlineMode, deadlineOverrun, log),
+					grpc_auth.StreamServerInterceptor(authenticate),
+					i.StreamServerInterceptor(),
+					FaultStreamServerInterceptor(log),
+					chaosMonkey.StreamServerInterceptor(),
+					CompressorStreamServerInterceptor(),
+					grpc_recovery.StreamServerInterceptor(),
+				),
+			),
+			grpc.UnaryInterceptor(
+				grpc_middleware.ChainUnaryServer(
+					grpc_prometheus.UnaryServerInterceptor,
+					grpc_zap.UnaryServerInterceptor(log),
+					DeadlineUnaryServerInterceptor(deadlineMode, deadlineOverrun, log),
+					grpc_auth.UnaryServerInterceptor(authenticate),
+					i.UnaryServerInterceptor(),
+					FaultUnaryServerInterceptor(log),
+					chaosMonkey.UnaryServerInterceptor(),
+					CompressorUnaryServerInterceptor(),
+					grpc_recovery.UnaryServerInterceptor(),
+				),
+			),
+		}, options...)...)
+		grpctest.RegisterGrpcTestServer(grpcServer, &server{
+			log:      log,
+			instance: i.id,
+			interval: interval,
+			sessions: sessions,
+			payloads: payloads,
+			shutdown: shutdown,
+		})
+		healthSrv := newHealthServer(log, "grpctest.GrpcTest")
+		healthSrv.watch(shutdown)
+		healthpb.RegisterHealthServer(grpcServer, healthSrv)
+		reflection.Register(grpcServer)
+		grpc_prometheus.Register(grpcServer)
+		return grpcServer, healthSrv
+	}
+
+	instances, err := newInstances(viper.GetInt(keyInstances), common.ListenAddress(port), build, conns, log)
+	if err != nil {
+		log.Fatal("Can't configure instances", zap.Error(err))
+	}
+	for _, i := range instances {
+		if err = i.start(); err != nil {
+			log.Fatal("Can't start instance", zap.Error(err), zap.String("instance", i.id))
+		}
+	}
+	admin.Handle("/health", healthHandler(instances))
+	admin.Handle("/instances", instancesHandler(instances, viper.GetDuration(keyShutdownTimeout)))
+	common.StartMetrics(log)
+	startAdmin(viper.GetString(keyAdmin), admin, log)
+
+	serveUntilSignal(instances, viper.GetDuration(keyShutdownTimeout), log)
 }
@@ -1,12 +1,79 @@
 package main
 
 import (
+	"crypto/rand"
 	"time"
 
+	"github.com/oklog/ulid"
 	"go.uber.org/zap"
+
+	"github.com/bclermont/grpctest/common"
+	grpctest "github.com/bclermont/grpctest/proto"
 )
 
 type server struct {
-	log      *zap.Logger
+	log *zap.Logger
+	// instance is the ID of the server instance, included in every response
+	instance string
 	interval time.Duration
+	// sessions track the sequence of the requests of every client session, across reconnects
+	sessions *common.SequenceSessions
+	payloads *common.PayloadGenerator
+	// shutdown is closed when the server stop, the streams then end
+	shutdown <-chan struct{}
+}
+
+// observe check the sequence number and the checksum of a received request, anomalies are logged
+func (s *server) observe(req *grpctest.Request) {
+	if !common.VerifyChecksum(req.Payload, req.Checksum) {
+		s.log.Warn("Payload checksum mismatch", req.ZapFields()...)
+	}
+	if len(req.SessionId) == 0 {
+		return
+	}
+	event := s.sessions.Tracker(req.SessionId).Observe(req.Sequence)
+	if event != common.SequenceInOrder {
+		s.log.Warn("Sequence anomaly", append(req.ZapFields(), zap.Stringer("event", event))...)
+	}
+}
+
+// logSession log the sequence stats of a client session
+func (s *server) logSession(session string) {
+	if len(session) == 0 {
+		return
+	}
+	stats := s.sessions.Tracker(session).Stats()
+	s.log.Info("Session sequence", append(stats.ZapFields(), zap.String("session", session))...)
+}
+
+// echoResponse create a response with the value and the payload of req
+func (s *server) echoResponse(req *grpctest.Request, session string, sequence uint64) *grpctest.Response {
+	return &grpctest.Response{
+		Value:     req.Value,
+		SessionId: session,
+		Sequence:  sequence,
+		SentAt:    req.SentAt,
+		Payload:   req.Payload,
+		Checksum:  req.Checksum,
+		Instance:  s.instance,
+	}
+}
+
+// newResponse create a dummy response, numbered by seq
+func (s *server) newResponse(seq *common.Sequencer, t time.Time) (*grpctest.Response, error) {
+	id, err := ulid.New(ulid.Timestamp(t), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	payload, checksum := s.payloads.Next()
+	sequence, sentAt := seq.Next()
+	return &grpctest.Response{
+		Value:     id.String(),
+		SessionId: seq.Session,
+		Sequence:  sequence,
+		SentAt:    sentAt,
+		Payload:   payload,
+		Checksum:  checksum,
+		Instance:  s.instance,
+	}, nil
 }
@@ -1,20 +1,37 @@
 package main
 
 import (
-	"crypto/rand"
 	"time"
 
-	"github.com/oklog/ulid"
 	"go.uber.org/zap"
 
+	"github.com/bclermont/grpctest/common"
 	grpctest "github.com/bclermont/grpctest/proto"
 )
 
-// ServerStream send response at some interval, until client close stream
+// ServerStream send response at some interval, until client close stream or the server shut down.
+// In echo mode, it send the request back the requested number of times and close the stream.
 func (s *server) ServerStream(req *grpctest.Request, stream grpctest.GrpcTest_ServerStreamServer) error {
 	// process request
 	s.log.Debug("Request received", req.ZapFields()...)
+	s.observe(req)
+	defer s.logSession(req.SessionId)
 
+	seq, err := common.NewSequencer()
+	if err != nil {
+		return err
+	}
+	if count := common.EchoCount(stream.Context()); count > 0 {
+		for i := 0; i < count; i++ {
+			sequence, _ := seq.Next()
+			resp := s.echoResponse(req, seq.Session, sequence)
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			s.log.Debug("Sent echo response", resp.ZapFields()...)
+		}
+		return nil
+	}
 	ticker := time.NewTicker(s.interval)
 	ctx := stream.Context()
 
@@ -22,13 +39,10 @@ func (s *server) ServerStream(req *grpctest.Request, stream grpctest.GrpcTest_Se
 		select {
 		case t := <-ticker.C:
 			// send some dummy response
-			id, err := ulid.New(ulid.Timestamp(t), rand.Reader)
+			resp, err := s.newResponse(seq, t)
 			if err != nil {
 				return err
 			}
-			resp := &grpctest.Response{
-				Value: id.String(),
-			}
 			if err := stream.Send(resp); err != nil {
 				return err
 			}
@@ -37,6 +51,10 @@ func (s *server) ServerStream(req *grpctest.Request, stream grpctest.GrpcTest_Se
 			s.log.Info("Context done, leaving", zap.Error(ctx.Err()))
 			ticker.Stop()
 			return ctx.Err()
+		case <-s.shutdown:
+			s.log.Info("Shutting down, end stream")
+			ticker.Stop()
+			return nil
 		}
 	}
 }
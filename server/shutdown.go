@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serveUntilSignal wait for SIGINT or SIGTERM, then drain the instances to end the streams and stop gracefully.
+// Remaining calls are cancelled after timeout or on a second signal, and the process exit with an error.
+func serveUntilSignal(instances []*instance, timeout time.Duration, log *zap.Logger) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Info("Shutting down", zap.Stringer("signal", sig), zap.Duration("timeout", timeout))
+
+	var wg sync.WaitGroup
+	for _, i := range instances {
+		drained, err := i.drain()
+		if err != nil {
+			// already stopped
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			<-drained
+			wg.Done()
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Info("Server stopped")
+		return
+	case <-time.After(timeout):
+		log.Warn("Calls still running after shutdown timeout, cancel them")
+	case sig := <-signals:
+		log.Warn("Signal received again, cancel running calls", zap.Stringer("signal", sig))
+	}
+	for _, i := range instances {
+		i.kill()
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/oklog/ulid"
+	"golang.org/x/net/context"
+
+	"github.com/bclermont/grpctest/common"
+	grpctest "github.com/bclermont/grpctest/proto"
+)
+
+// Unary log received request and answer with a single response
+func (s *server) Unary(ctx context.Context, req *grpctest.Request) (*grpctest.Response, error) {
+	// process request
+	s.log.Debug("Request received", req.ZapFields()...)
+	s.observe(req)
+	if common.EchoCount(ctx) > 0 {
+		resp := s.echoResponse(req, req.SessionId, req.Sequence)
+		s.log.Debug("Sent echo response", resp.ZapFields()...)
+		return resp, nil
+	}
+
+	id, err := ulid.New(ulid.Now(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	// the response echo the sequence of its request
+	payload, checksum := s.payloads.Next()
+	resp := &grpctest.Response{
+		Value:     id.String(),
+		SessionId: req.SessionId,
+		Sequence:  req.Sequence,
+		SentAt:    time.Now().UnixNano(),
+		Payload:   payload,
+		Checksum:  checksum,
+		Instance:  s.instance,
+	}
+	s.log.Debug("Sent response", resp.ZapFields()...)
+	return resp, nil
+}